@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"adserving/config"
+	"adserving/db"
+	"adserving/handlers"
+)
+
+// runCLI runs the subcommand named by args[0], if any, and reports whether
+// one was run. Subcommands connect to the same database as the server.
+func runCLI(cfg *config.Config, args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	switch args[0] {
+	case "explain":
+		runExplain(cfg, args[1:])
+	case "spool":
+		runSpool(cfg, args[1:])
+	default:
+		return false
+	}
+	return true
+}
+
+// runExplain prints which rule a request would match and why, e.g.
+//
+//	adserving explain -pid 200 -ua "Mozilla/5.0 (Linux; Android 14)" -cc US
+func runExplain(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	var in handlers.ExplainInput
+	fs.IntVar(&in.PublisherID, "pid", 0, "publisher id")
+	fs.StringVar(&in.UserAgent, "ua", "", "user agent")
+	fs.StringVar(&in.CountryCode, "cc", "US", "country code")
+	fs.StringVar(&in.Domain, "d", "", "publisher domain")
+	fs.StringVar(&in.Slot, "slot", "", "slot id")
+	fs.StringVar(&in.Referrer, "ref", "", "referrer")
+	fs.StringVar(&in.LayoutID, "lid", "", "layout id request param")
+	fs.StringVar(&in.TemplateSize, "tsize", "", "template size request param")
+	fs.StringVar(&in.VisitorID, "vid", "", "visitor id (adx_vid cookie) for experiment assignment")
+	at := fs.String("at", "", "evaluate schedules at this RFC 3339 time instead of now")
+	fs.Parse(args)
+
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "explain: -at must be an RFC 3339 time")
+			os.Exit(2)
+		}
+		in.At = t
+	}
+	if in.PublisherID <= 0 {
+		fmt.Fprintln(os.Stderr, "explain: -pid is required")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := db.Init(cfg.DBDsn); err != nil {
+		log.Fatalf("DB init error: %v", err)
+	}
+	defer db.Close()
+
+	config.SetRulesDB(db.GetDB())
+	if err := config.ReloadRules(); err != nil {
+		log.Fatalf("rule load error: %v", err)
+	}
+
+	out, err := json.MarshalIndent(handlers.Explain(in), "", "  ")
+	if err != nil {
+		log.Fatalf("explain: %v", err)
+	}
+	fmt.Println(string(out))
+}
+
+// runSpool inspects or replays the tracking event spool:
+//
+//	adserving spool inspect [-dir storage/spool] [-records]
+//	adserving spool replay [-dir storage/spool]
+//
+// Replay while the server is stopped; a running server replays the spool
+// itself once the database is reachable.
+func runSpool(cfg *config.Config, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: spool inspect|replay [-dir dir]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("spool "+args[0], flag.ExitOnError)
+	dir := fs.String("dir", cfg.EventSpoolDir, "spool directory")
+	records := fs.Bool("records", false, "inspect: print every record as JSON")
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "inspect":
+		inspectSpool(*dir, *records)
+	case "replay":
+		replaySpool(cfg, *dir)
+	default:
+		fmt.Fprintf(os.Stderr, "spool: unknown command %q\n", args[0])
+		os.Exit(2)
+	}
+}
+
+// inspectSpool prints a summary of every segment, including those set
+// aside as corrupt.
+func inspectSpool(dir string, records bool) {
+	paths, err := filepath.Glob(filepath.Join(dir, "events-*.spool*"))
+	if err != nil {
+		log.Fatalf("spool inspect: %v", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, path := range paths {
+		if strings.HasSuffix(path, ".offset") {
+			continue
+		}
+		var printRecord func(db.SpoolRecord)
+		if records {
+			printRecord = func(rec db.SpoolRecord) {
+				if err := enc.Encode(rec); err != nil {
+					log.Fatalf("spool inspect: %v", err)
+				}
+			}
+		}
+		out, err := json.MarshalIndent(db.InspectSegment(path, printRecord), "", "  ")
+		if err != nil {
+			log.Fatalf("spool inspect %s: %v", path, err)
+		}
+		fmt.Println(string(out))
+	}
+}
+
+func replaySpool(cfg *config.Config, dir string) {
+	if err := db.Init(cfg.DBDsn); err != nil {
+		log.Fatalf("DB init error: %v", err)
+	}
+	defer db.Close()
+
+	spool, err := db.OpenSpool(dir, int64(cfg.EventSpoolSegmentBytes))
+	if err != nil {
+		log.Fatalf("spool open: %v", err)
+	}
+	defer spool.Close()
+
+	n, err := spool.Replay(context.Background(), db.GetDB())
+	fmt.Printf("replayed %d rows\n", n)
+	if err != nil {
+		log.Fatalf("spool replay: %v", err)
+	}
+}
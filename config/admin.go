@@ -0,0 +1,392 @@
+package config
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	ErrRuleNotFound    = errors.New("rule not found")
+	ErrDuplicateRule   = errors.New("a rule with this name already exists for the publisher")
+	ErrNoDatabase      = errors.New("rules database not configured")
+	ErrVersionNotFound = errors.New("rule version not found")
+	ErrVersionDeleted  = errors.New("rule version records a deletion and cannot be restored")
+	ErrVersionInvalid  = errors.New("rule version has unreadable conditions and cannot be restored")
+)
+
+// RuleHistoryEntry is one recorded mutation of a rule. Before is nil for a
+// create and After is nil for a delete.
+type RuleHistoryEntry struct {
+	ID        int       `json:"id"`
+	RuleID    int       `json:"rule_id"`
+	Version   int       `json:"version"`
+	Operation string    `json:"operation"`
+	Actor     string    `json:"actor"`
+	Before    *Rule     `json:"before"`
+	After     *Rule     `json:"after"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListRules returns the rules of one publisher, or of every publisher when
+// publisherID is 0, in evaluation order. It reads the database rather than
+// the in-memory store so admins always see what is persisted.
+func ListRules(publisherID int) ([]Rule, error) {
+	if rulesDBConn == nil {
+		return nil, ErrNoDatabase
+	}
+
+	query := `SELECT ` + ruleColumns + ` FROM rules`
+	var args []any
+	if publisherID > 0 {
+		query += ` WHERE publisher_id = ?`
+		args = append(args, publisherID)
+	}
+	query += ` ORDER BY publisher_id, priority DESC, id`
+
+	rows, err := rulesDBConn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanRules(rows)
+}
+
+func GetRule(id int) (Rule, error) {
+	if rulesDBConn == nil {
+		return Rule{}, ErrNoDatabase
+	}
+
+	rows, err := rulesDBConn.Query(`SELECT `+ruleColumns+` FROM rules WHERE id = ?`, id)
+	if err != nil {
+		return Rule{}, err
+	}
+	rules, err := scanRules(rows)
+	if err != nil {
+		return Rule{}, err
+	}
+	if len(rules) == 0 {
+		return Rule{}, ErrRuleNotFound
+	}
+	return rules[0], nil
+}
+
+// CreateRule inserts a new rule and returns it with its assigned id.
+func CreateRule(rule Rule, actor string) (Rule, error) {
+	return mutateRule(0, "create", actor, func(tx *sql.Tx) (int, error) {
+		actionJSON, conditionsJSON, err := marshalRuleJSON(rule)
+		if err != nil {
+			return 0, err
+		}
+		res, err := tx.Exec(`
+			INSERT INTO rules (rule_name, action, publisher_id, user_agent, country_code, priority, conditions, enabled)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, rule.RuleName, actionJSON, rule.PublisherID, rule.UserAgent, rule.CountryCode, rule.Priority, conditionsJSON, rule.Enabled)
+		if err != nil {
+			return 0, err
+		}
+		id, err := res.LastInsertId()
+		return int(id), err
+	})
+}
+
+// UpdateRule replaces every field of an existing rule.
+func UpdateRule(rule Rule, actor string) (Rule, error) {
+	return mutateRule(rule.ID, "update", actor, func(tx *sql.Tx) (int, error) {
+		return rule.ID, writeRuleTx(tx, rule)
+	})
+}
+
+func DeleteRule(id int, actor string) error {
+	_, err := mutateRule(id, "delete", actor, func(tx *sql.Tx) (int, error) {
+		_, err := tx.Exec(`DELETE FROM rules WHERE id = ?`, id)
+		return id, err
+	})
+	return err
+}
+
+func SetRuleEnabled(id int, enabled bool, actor string) (Rule, error) {
+	op := "disable"
+	if enabled {
+		op = "enable"
+	}
+	return mutateRule(id, op, actor, func(tx *sql.Tx) (int, error) {
+		_, err := tx.Exec(`UPDATE rules SET enabled = ? WHERE id = ?`, enabled, id)
+		return id, err
+	})
+}
+
+// RollbackRule restores a rule to the state recorded by the given history
+// version. A rule that has since been deleted is re-created with its
+// original id.
+func RollbackRule(id, version int, actor string) (Rule, error) {
+	if rulesDBConn == nil {
+		return Rule{}, ErrNoDatabase
+	}
+
+	tx, err := rulesDBConn.Begin()
+	if err != nil {
+		return Rule{}, err
+	}
+	defer tx.Rollback()
+
+	var afterJSON sql.NullString
+	err = tx.QueryRow(`
+		SELECT CAST(after_state AS CHAR) FROM rule_history WHERE rule_id = ? AND version = ?
+	`, id, version).Scan(&afterJSON)
+	if err == sql.ErrNoRows {
+		return Rule{}, ErrVersionNotFound
+	}
+	if err != nil {
+		return Rule{}, err
+	}
+	if !afterJSON.Valid {
+		return Rule{}, ErrVersionDeleted
+	}
+
+	snapshot, err := decodeSnapshot(afterJSON)
+	if err != nil {
+		return Rule{}, err
+	}
+	if snapshot.badConditions {
+		// Writing it back would store empty conditions, matching everything
+		return Rule{}, ErrVersionInvalid
+	}
+	target := *snapshot
+	target.ID = id
+
+	before, err := getRuleTx(tx, id)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	if before != nil {
+		err = writeRuleTx(tx, target)
+	} else {
+		err = insertRuleWithIDTx(tx, target)
+	}
+	if err != nil {
+		return Rule{}, translateRuleError(err)
+	}
+
+	return finishMutation(tx, id, "rollback", actor, before)
+}
+
+// RuleHistory returns the recorded versions of a rule, newest first.
+func RuleHistory(id int) ([]RuleHistoryEntry, error) {
+	if rulesDBConn == nil {
+		return nil, ErrNoDatabase
+	}
+
+	rows, err := rulesDBConn.Query(`
+		SELECT id, rule_id, version, operation, actor,
+			CAST(before_state AS CHAR), CAST(after_state AS CHAR), created_at
+		FROM rule_history WHERE rule_id = ? ORDER BY version DESC
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []RuleHistoryEntry
+	for rows.Next() {
+		var e RuleHistoryEntry
+		var beforeJSON, afterJSON sql.NullString
+		if err := rows.Scan(&e.ID, &e.RuleID, &e.Version, &e.Operation, &e.Actor, &beforeJSON, &afterJSON, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if e.Before, err = decodeSnapshot(beforeJSON); err != nil {
+			return nil, err
+		}
+		if e.After, err = decodeSnapshot(afterJSON); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// mutateRule runs fn in a transaction with the rule's current row locked,
+// then records the before and after states as the rule's next history
+// version. fn returns the id of the rule it touched.
+func mutateRule(id int, op, actor string, fn func(tx *sql.Tx) (int, error)) (Rule, error) {
+	if rulesDBConn == nil {
+		return Rule{}, ErrNoDatabase
+	}
+
+	tx, err := rulesDBConn.Begin()
+	if err != nil {
+		return Rule{}, err
+	}
+	defer tx.Rollback()
+
+	var before *Rule
+	if id > 0 {
+		if before, err = getRuleTx(tx, id); err != nil {
+			return Rule{}, err
+		}
+		if before == nil {
+			return Rule{}, ErrRuleNotFound
+		}
+	}
+
+	ruleID, err := fn(tx)
+	if err != nil {
+		return Rule{}, translateRuleError(err)
+	}
+
+	return finishMutation(tx, ruleID, op, actor, before)
+}
+
+// finishMutation writes the history entry, commits and refreshes the
+// in-memory rules. It returns the rule's new state (zero after a delete).
+func finishMutation(tx *sql.Tx, ruleID int, op, actor string, before *Rule) (Rule, error) {
+	after, err := getRuleTx(tx, ruleID)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	beforeJSON, err := encodeSnapshot(before)
+	if err != nil {
+		return Rule{}, err
+	}
+	afterJSON, err := encodeSnapshot(after)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	// Rules created outside the API (seeds, manual SQL) have no history yet;
+	// record their prior state as a baseline version so it can be restored.
+	if before != nil {
+		_, err = tx.Exec(`
+			INSERT INTO rule_history (rule_id, version, operation, actor, before_state, after_state)
+			SELECT ?, 1, 'baseline', 'system', NULL, ? FROM DUAL
+			WHERE NOT EXISTS (SELECT 1 FROM rule_history WHERE rule_id = ?)
+		`, ruleID, beforeJSON, ruleID)
+		if err != nil {
+			return Rule{}, err
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO rule_history (rule_id, version, operation, actor, before_state, after_state)
+		SELECT ?, COALESCE(MAX(version), 0) + 1, ?, ?, ?, ? FROM rule_history WHERE rule_id = ?
+	`, ruleID, op, actor, beforeJSON, afterJSON, ruleID)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Rule{}, err
+	}
+	if err := ReloadRules(); err != nil {
+		log.Printf("rule reload after %s of rule %d failed: %v", op, ruleID, err)
+	}
+
+	if after == nil {
+		return Rule{}, nil
+	}
+	return *after, nil
+}
+
+// getRuleTx reads and locks a rule row, returning nil if it does not exist.
+func getRuleTx(tx *sql.Tx, id int) (*Rule, error) {
+	rows, err := tx.Query(`SELECT `+ruleColumns+` FROM rules WHERE id = ? FOR UPDATE`, id)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := scanRules(rows)
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+	return &rules[0], nil
+}
+
+func writeRuleTx(tx *sql.Tx, rule Rule) error {
+	actionJSON, conditionsJSON, err := marshalRuleJSON(rule)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE rules SET rule_name = ?, action = ?, publisher_id = ?, user_agent = ?, country_code = ?,
+			priority = ?, conditions = ?, enabled = ?
+		WHERE id = ?
+	`, rule.RuleName, actionJSON, rule.PublisherID, rule.UserAgent, rule.CountryCode,
+		rule.Priority, conditionsJSON, rule.Enabled, rule.ID)
+	return err
+}
+
+func insertRuleWithIDTx(tx *sql.Tx, rule Rule) error {
+	actionJSON, conditionsJSON, err := marshalRuleJSON(rule)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO rules (id, rule_name, action, publisher_id, user_agent, country_code, priority, conditions, enabled)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, rule.ID, rule.RuleName, actionJSON, rule.PublisherID, rule.UserAgent, rule.CountryCode,
+		rule.Priority, conditionsJSON, rule.Enabled)
+	return err
+}
+
+// ruleSnapshot is a rule as stored in rule_history. A rule whose conditions
+// could not be read keeps the stored JSON in InvalidConditions, since its
+// Conditions are empty.
+type ruleSnapshot struct {
+	Rule
+	InvalidConditions string `json:"invalid_conditions,omitempty"`
+}
+
+func encodeSnapshot(rule *Rule) (any, error) {
+	if rule == nil {
+		return nil, nil
+	}
+	snap := ruleSnapshot{Rule: *rule}
+	if rule.badConditions {
+		snap.InvalidConditions = rule.rawConditions
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func decodeSnapshot(s sql.NullString) (*Rule, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	var snap ruleSnapshot
+	if err := json.Unmarshal([]byte(s.String), &snap); err != nil {
+		return nil, err
+	}
+	rule := snap.Rule
+	if snap.InvalidConditions != "" {
+		rule.badConditions = true
+		rule.rawConditions = snap.InvalidConditions
+	}
+	return &rule, nil
+}
+
+func marshalRuleJSON(rule Rule) (string, string, error) {
+	actionJSON, err := json.Marshal(rule.Action)
+	if err != nil {
+		return "", "", err
+	}
+	conditionsJSON, err := json.Marshal(rule.Conditions)
+	if err != nil {
+		return "", "", err
+	}
+	return string(actionJSON), string(conditionsJSON), nil
+}
+
+func translateRuleError(err error) error {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) && myErr.Number == 1062 {
+		return ErrDuplicateRule
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestSnapshotKeepsUnreadableConditions(t *testing.T) {
+	rule := Rule{ID: 7, RuleName: "r", PublisherID: 100, Enabled: true}
+	parseRuleJSON(&rule, `{"serp_template_id":"SerpTemplate1.html"}`, `{"countries":"US"}`)
+	if !rule.badConditions {
+		t.Fatal("conditions with the wrong type should be unreadable")
+	}
+
+	enc, err := encodeSnapshot(&rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeSnapshot(sql.NullString{String: enc.(string), Valid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.badConditions || got.rawConditions != `{"countries":"US"}` {
+		t.Errorf("decoded snapshot lost the unreadable conditions: %+v", got)
+	}
+	if ok, _ := got.Matches(RuleContext{CountryCode: "US"}); ok {
+		t.Error("a rule with unreadable conditions must not match")
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	rule := Rule{ID: 7, RuleName: "r", PublisherID: 100, Enabled: true,
+		Conditions: RuleConditions{Countries: []string{"DE"}}}
+	enc, err := encodeSnapshot(&rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeSnapshot(sql.NullString{String: enc.(string), Valid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.badConditions || len(got.Conditions.Countries) != 1 || got.Conditions.Countries[0] != "DE" {
+		t.Errorf("round trip changed the rule: %+v", got)
+	}
+}
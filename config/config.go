@@ -1,11 +1,93 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"time"
+)
 
 type Config struct {
 	DBDsn      string
 	ServerAddr string
 	APIBaseURL string
+	AdminToken string
+	// MetricsAddr is the internal listener serving /debug/vars; empty
+	// disables it.
+	MetricsAddr string
+	// TrustedProxies lists the networks (comma-separated CIDRs) whose
+	// X-Forwarded-For and X-Real-IP headers name the client; everyone
+	// else is identified by the connection address. Only loopback is
+	// trusted by default, so load balancers must be listed explicitly.
+	TrustedProxies string
+
+	// KeywordStaticFile, when set, enables the "static" keyword provider.
+	KeywordStaticFile string
+	// KeywordCacheTTL is how long keyword API responses are reused; 0
+	// disables the cache.
+	KeywordCacheTTL time.Duration
+
+	// Ads feed endpoint and the partner/source tags sent with every call
+	AdsAPIBaseURL string
+	AdsPartner    string
+	AdsSourceTag  string
+	// AdsJSONAPIBaseURL, when set, enables the "json" ad feed.
+	AdsJSONAPIBaseURL string
+	// AdsAuctionTimeout is how long the SERP waits for ad feeds.
+	AdsAuctionTimeout time.Duration
+
+	// Upstream call budgets and resilience settings
+	KeywordAPITimeout time.Duration
+	AdsAPITimeout     time.Duration
+	UpstreamRetries   int
+	BreakerThreshold  int
+	BreakerCooldown   time.Duration
+
+	// Tracking event pipeline: queue bound, writer pool, batch size and
+	// age, and what to do when the queue is full ("drop" or "block", the
+	// latter waiting up to EventBlockTimeout)
+	EventQueueSize     int
+	EventWorkers       int
+	EventBatchSize     int
+	EventFlushInterval time.Duration
+	EventQueuePolicy   string
+	EventBlockTimeout  time.Duration
+	// Batches the database rejects are spooled to EventSpoolDir in
+	// segments of EventSpoolSegmentBytes and replayed every
+	// EventSpoolReplayInterval once it is back.
+	EventSpoolDir            string
+	EventSpoolSegmentBytes   int
+	EventSpoolReplayInterval time.Duration
+
+	// Tracking links are signed with TrackingKeys ("id:secret,...", the
+	// first one signing) and honoured for TrackingLinkTTL. TRACKING_KEYS is
+	// required: the server does not start without it, since ad clicks are
+	// only redirected on a valid signature. In "enforce" mode links that
+	// are not validly signed are refused; in "flag" mode they are only
+	// marked as such.
+	TrackingKeys          string
+	TrackingLinkTTL       time.Duration
+	TrackingSignatureMode string
+
+	// Ad click quality: repeats within ClickDedupeWindow (0 = off) are
+	// ignored; more than ClickIPLimit clicks per IP, or ClickIPUALimit per
+	// IP and user agent, within ClickVelocityWindow are flagged, as are
+	// clicks sooner than ClickMinDelay after the ad was shown or from the
+	// networks listed in ClickDatacenterRanges (a file of CIDRs). Served
+	// SERPs are remembered for ClickImpressionTTL.
+	ClickDedupeWindow     time.Duration
+	ClickVelocityWindow   time.Duration
+	ClickIPLimit          int
+	ClickIPUALimit        int
+	ClickMinDelay         time.Duration
+	ClickImpressionTTL    time.Duration
+	ClickDatacenterRanges string
+
+	// ShutdownTimeout is how long in-flight requests get to finish after
+	// SIGINT/SIGTERM before they are canceled.
+	ShutdownTimeout time.Duration
+
+	RulesPollInterval    time.Duration
+	RulesRefreshInterval time.Duration
 }
 
 func Load() *Config {
@@ -19,10 +101,103 @@ func Load() *Config {
 		addr = ":8000"
 	}
 
+	metricsAddr, ok := os.LookupEnv("METRICS_ADDR")
+	if !ok {
+		metricsAddr = "127.0.0.1:8001"
+	}
+
+	trustedProxies, ok := os.LookupEnv("TRUSTED_PROXIES")
+	if !ok {
+		trustedProxies = "127.0.0.0/8,::1/128"
+	}
+
 	apiBase := os.Getenv("KEYWORD_API_BASE")
 	if apiBase == "" {
 		apiBase = "http://g-usw1b-kwd-api-realapi.srv.media.net/kbb/keyword_api.php"
 	}
 
-	return &Config{DBDsn: dsn, ServerAddr: addr, APIBaseURL: apiBase}
+	adsBase := os.Getenv("ADS_API_BASE")
+	if adsBase == "" {
+		adsBase = "https://contextual-stage.media.net/test/mock/provider/yahoo.xml"
+	}
+
+	eventPolicy := os.Getenv("EVENT_QUEUE_POLICY")
+	if eventPolicy == "" {
+		eventPolicy = "drop"
+	}
+
+	spoolDir := os.Getenv("EVENT_SPOOL_DIR")
+	if spoolDir == "" {
+		spoolDir = "storage/spool"
+	}
+
+	sigMode := os.Getenv("TRACKING_SIGNATURE_MODE")
+	if sigMode == "" {
+		sigMode = "flag"
+	}
+
+	return &Config{
+		DBDsn:                    dsn,
+		ServerAddr:               addr,
+		APIBaseURL:               apiBase,
+		AdminToken:               os.Getenv("ADMIN_TOKEN"),
+		MetricsAddr:              metricsAddr,
+		TrustedProxies:           trustedProxies,
+		KeywordStaticFile:        os.Getenv("KEYWORD_STATIC_FILE"),
+		KeywordCacheTTL:          envDurationOrZero("KEYWORD_CACHE_TTL", 5*time.Minute),
+		AdsAPIBaseURL:            adsBase,
+		AdsPartner:               os.Getenv("ADS_PARTNER"),
+		AdsSourceTag:             os.Getenv("ADS_SOURCE_TAG"),
+		AdsJSONAPIBaseURL:        os.Getenv("ADS_JSON_API_BASE"),
+		AdsAuctionTimeout:        envDuration("ADS_AUCTION_TIMEOUT", 2500*time.Millisecond),
+		KeywordAPITimeout:        envDuration("KEYWORD_API_TIMEOUT", 2*time.Second),
+		AdsAPITimeout:            envDuration("ADS_API_TIMEOUT", 2*time.Second),
+		UpstreamRetries:          envInt("UPSTREAM_RETRIES", 1),
+		BreakerThreshold:         envInt("BREAKER_THRESHOLD", 5),
+		BreakerCooldown:          envDuration("BREAKER_COOLDOWN", 30*time.Second),
+		EventQueueSize:           envInt("EVENT_QUEUE_SIZE", 10000),
+		EventWorkers:             envInt("EVENT_WORKERS", 2),
+		EventBatchSize:           envInt("EVENT_BATCH_SIZE", 200),
+		EventFlushInterval:       envDuration("EVENT_FLUSH_INTERVAL", time.Second),
+		EventQueuePolicy:         eventPolicy,
+		EventBlockTimeout:        envDuration("EVENT_BLOCK_TIMEOUT", 50*time.Millisecond),
+		EventSpoolDir:            spoolDir,
+		EventSpoolSegmentBytes:   envInt("EVENT_SPOOL_SEGMENT_BYTES", 16<<20),
+		EventSpoolReplayInterval: envDuration("EVENT_SPOOL_REPLAY_INTERVAL", 10*time.Second),
+		TrackingKeys:             os.Getenv("TRACKING_KEYS"),
+		TrackingLinkTTL:          envDuration("TRACKING_LINK_TTL", 24*time.Hour),
+		TrackingSignatureMode:    sigMode,
+		ClickDedupeWindow:        envDurationOrZero("CLICK_DEDUPE_WINDOW", 30*time.Second),
+		ClickVelocityWindow:      envDuration("CLICK_VELOCITY_WINDOW", time.Minute),
+		ClickIPLimit:             envInt("CLICK_IP_LIMIT", 10),
+		ClickIPUALimit:           envInt("CLICK_IP_UA_LIMIT", 5),
+		ClickMinDelay:            envDurationOrZero("CLICK_MIN_DELAY", time.Second),
+		ClickImpressionTTL:       envDuration("CLICK_IMPRESSION_TTL", time.Hour),
+		ClickDatacenterRanges:    os.Getenv("CLICK_DATACENTER_RANGES"),
+		ShutdownTimeout:          envDuration("SHUTDOWN_TIMEOUT", 10*time.Second),
+		RulesPollInterval:        envDuration("RULES_POLL_INTERVAL", 5*time.Second),
+		RulesRefreshInterval:     envDuration("RULES_REFRESH_INTERVAL", 5*time.Minute),
+	}
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n >= 0 {
+		return n
+	}
+	return def
+}
+
+// envDurationOrZero is envDuration for settings where 0 means "off".
+func envDurationOrZero(key string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d >= 0 {
+		return d
+	}
+	return def
 }
@@ -0,0 +1,238 @@
+package config
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"adserving/utils"
+)
+
+// TimeWindow restricts a rule to a daily "HH:MM"-"HH:MM" range in the
+// publisher's time zone. A window whose From is after To wraps past midnight.
+type TimeWindow struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Schedule restricts a rule to days of the week ("mon".."sun") and hours of
+// the day (0-23) in the publisher's time zone. Empty lists allow all.
+type Schedule struct {
+	Days  []string `json:"days,omitempty"`
+	Hours []int    `json:"hours,omitempty"`
+}
+
+// RuleConditions are ANDed; an empty field matches everything. StartsAt and
+// EndsAt bound when the rule is active at all; they accept RFC 3339 or a
+// local "2006-01-02T15:04" read in the publisher's time zone.
+type RuleConditions struct {
+	UserAgent   string      `json:"user_agent,omitempty"`
+	Countries   []string    `json:"countries,omitempty"`
+	Domains     []string    `json:"domains,omitempty"`
+	Slots       []string    `json:"slots,omitempty"`
+	DeviceClass string      `json:"device_class,omitempty"`
+	Referrer    string      `json:"referrer,omitempty"`
+	TimeWindow  *TimeWindow `json:"time_window,omitempty"`
+	StartsAt    string      `json:"starts_at,omitempty"`
+	EndsAt      string      `json:"ends_at,omitempty"`
+	Schedule    *Schedule   `json:"schedule,omitempty"`
+}
+
+// RuleContext is the request-side input to rule evaluation.
+type RuleContext struct {
+	PublisherID int
+	UserAgent   string
+	CountryCode string
+	Domain      string
+	Slot        string
+	Referrer    string
+	Now         time.Time
+}
+
+// Match reports whether every condition holds for ctx. When it does not,
+// the returned string names the first condition that failed. Time-based
+// conditions read ctx.Now in whatever location it carries.
+func (c RuleConditions) Match(ctx RuleContext) (bool, string) {
+	if c.UserAgent != "" && !containsFold(ctx.UserAgent, c.UserAgent) {
+		return false, "user_agent"
+	}
+	if len(c.Countries) > 0 && !matchCountry(c.Countries, ctx.CountryCode) {
+		return false, "country"
+	}
+	if len(c.Domains) > 0 && !matchDomain(c.Domains, ctx.Domain) {
+		return false, "domain"
+	}
+	if len(c.Slots) > 0 && !containsString(c.Slots, ctx.Slot) {
+		return false, "slot"
+	}
+	if c.DeviceClass != "" && !strings.EqualFold(c.DeviceClass, utils.DeviceClass(ctx.UserAgent)) {
+		return false, "device_class"
+	}
+	if c.Referrer != "" && !containsFold(ctx.Referrer, c.Referrer) {
+		return false, "referrer"
+	}
+	if c.StartsAt != "" {
+		start, err := ParseScheduleTime(c.StartsAt, ctx.Now.Location())
+		if err != nil || ctx.Now.Before(start) {
+			return false, "starts_at"
+		}
+	}
+	if c.EndsAt != "" {
+		end, err := ParseScheduleTime(c.EndsAt, ctx.Now.Location())
+		if err != nil || !ctx.Now.Before(end) {
+			return false, "ends_at"
+		}
+	}
+	if c.Schedule != nil {
+		if len(c.Schedule.Days) > 0 && !containsFoldString(c.Schedule.Days, weekdayNames[ctx.Now.Weekday()]) {
+			return false, "schedule_day"
+		}
+		if len(c.Schedule.Hours) > 0 && !containsInt(c.Schedule.Hours, ctx.Now.Hour()) {
+			return false, "schedule_hour"
+		}
+	}
+	if c.TimeWindow != nil && !c.TimeWindow.contains(ctx.Now) {
+		return false, "time_window"
+	}
+	return true, ""
+}
+
+// effectiveConditions folds the legacy user_agent/country_code columns
+// into the rule's conditions when the JSON does not set them itself.
+func (r Rule) effectiveConditions() RuleConditions {
+	c := r.Conditions
+	if c.UserAgent == "" {
+		c.UserAgent = r.UserAgent
+	}
+	if len(c.Countries) == 0 && r.CountryCode != "" && r.CountryCode != "*" {
+		c.Countries = []string{r.CountryCode}
+	}
+	return c
+}
+
+// Matches reports whether the rule applies to ctx. Schedules are evaluated
+// in the time zone of the rule's publisher.
+func (r Rule) Matches(ctx RuleContext) (bool, string) {
+	if !r.Enabled {
+		return false, "disabled"
+	}
+	if r.badConditions {
+		// A rule whose conditions cannot be read must never match broadly.
+		return false, "invalid_conditions"
+	}
+	if ctx.Now.IsZero() {
+		ctx.Now = time.Now()
+	}
+	if r.location != nil {
+		ctx.Now = ctx.Now.In(r.location)
+	}
+	return r.effectiveConditions().Match(ctx)
+}
+
+// SortRules orders rules by priority (highest first), then by id so that
+// evaluation is deterministic when priorities tie.
+func SortRules(rules []Rule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority > rules[j].Priority
+		}
+		return rules[i].ID < rules[j].ID
+	})
+}
+
+// SelectRule returns the first rule, by priority, whose conditions all
+// match ctx. rules must already be sorted with SortRules.
+func SelectRule(rules []Rule, ctx RuleContext) Rule {
+	for _, rule := range rules {
+		if ok, _ := rule.Matches(ctx); ok {
+			return rule
+		}
+	}
+	return DefaultRule
+}
+
+func (tw TimeWindow) contains(t time.Time) bool {
+	from, errFrom := time.Parse("15:04", tw.From)
+	to, errTo := time.Parse("15:04", tw.To)
+	if errFrom != nil || errTo != nil {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	start := from.Hour()*60 + from.Minute()
+	end := to.Hour()*60 + to.Minute()
+	if start <= end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+var weekdayNames = [...]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ValidWeekday reports whether s is one of "mon".."sun".
+func ValidWeekday(s string) bool {
+	return containsFoldString(weekdayNames[:], s)
+}
+
+// ParseScheduleTime parses an RFC 3339 time, or a local "2006-01-02T15:04"
+// (or with a space) in loc.
+func ParseScheduleTime(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04", s, loc); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04", s, loc)
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFoldString(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCountry(countries []string, cc string) bool {
+	for _, c := range countries {
+		if c == "*" || strings.EqualFold(c, cc) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain accepts an exact host or any subdomain of it.
+func matchDomain(domains []string, host string) bool {
+	host = strings.ToLower(strings.TrimPrefix(host, "www."))
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "www."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
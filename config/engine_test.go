@@ -0,0 +1,93 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+// seededRules returns a publisher's SeedRules as LoadPublisherRules would,
+// enabled as the column defaults to.
+func seededRules(publisherID int) []Rule {
+	var rules []Rule
+	for i, s := range SeedRules {
+		if s.PublisherID != publisherID {
+			continue
+		}
+		rule := Rule{
+			ID:          i + 1,
+			RuleName:    s.RuleName,
+			PublisherID: s.PublisherID,
+			UserAgent:   s.UserAgent,
+			CountryCode: s.CountryCode,
+			Priority:    s.Priority,
+			Enabled:     true,
+		}
+		parseRuleJSON(&rule, s.Action, "")
+		rules = append(rules, rule)
+	}
+	SortRules(rules)
+	return rules
+}
+
+func TestSortRulesSeeded(t *testing.T) {
+	rules := seededRules(100)
+	want := []string{"publisher_100_googlebot", "publisher_100_android", "publisher_100_bot", "publisher_100_default"}
+	if len(rules) != len(want) {
+		t.Fatalf("got %d seeded rules, want %d", len(rules), len(want))
+	}
+	for i, name := range want {
+		if rules[i].RuleName != name {
+			t.Fatalf("rules[%d] = %s, want %s", i, rules[i].RuleName, name)
+		}
+	}
+}
+
+func TestSelectRuleSeeded(t *testing.T) {
+	const (
+		googlebot = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+		android   = "Mozilla/5.0 (Linux; Android 13; Pixel 7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Mobile Safari/537.36"
+		bingbot   = "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)"
+		desktop   = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36"
+	)
+
+	tests := []struct {
+		name    string
+		ua      string
+		country string
+		want    string
+	}{
+		{"googlebot", googlebot, "US", "publisher_100_googlebot"},
+		{"android", android, "US", "publisher_100_android"},
+		{"generic bot", bingbot, "US", "publisher_100_bot"},
+		{"desktop", desktop, "US", "publisher_100_default"},
+		{"non-US desktop", desktop, "DE", "publisher_100_default"},
+		{"non-US googlebot", googlebot, "DE", "publisher_100_default"},
+		{"non-US android", android, "IN", "publisher_100_default"},
+	}
+
+	rules := seededRules(100)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SelectRule(rules, RuleContext{PublisherID: 100, UserAgent: tt.ua, CountryCode: tt.country, Now: now})
+			if got.RuleName != tt.want {
+				t.Errorf("SelectRule = %q, want %q", got.RuleName, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectRuleSeededAction(t *testing.T) {
+	got := SelectRule(seededRules(200), RuleContext{PublisherID: 200, UserAgent: "Mozilla/5.0", CountryCode: "US"})
+	if got.Action.SerpTemplateID != "SerpTemplate3.html" || got.Action.KeywordTemplateID != "KeywordTemplate3.html" {
+		t.Errorf("publisher 200 default action = %+v", got.Action)
+	}
+}
+
+func TestSelectRuleNoMatch(t *testing.T) {
+	rules := seededRules(100)[:3] // without the catch-all
+	got := SelectRule(rules, RuleContext{PublisherID: 100, UserAgent: "curl/8.0", CountryCode: "US"})
+	if got.RuleName != DefaultRule.RuleName {
+		t.Errorf("SelectRule = %q, want the global default", got.RuleName)
+	}
+}
@@ -0,0 +1,68 @@
+package config
+
+import "hash/fnv"
+
+// Experiment splits a rule's traffic across weighted variants. Each variant
+// may replace the rule's templates; empty fields keep the rule's value.
+type Experiment struct {
+	ID       string              `json:"id"`
+	Variants []ExperimentVariant `json:"variants"`
+}
+
+type ExperimentVariant struct {
+	ID                string `json:"id"`
+	Weight            int    `json:"weight"`
+	SerpTemplateID    string `json:"serp_template_id,omitempty"`
+	KeywordTemplateID string `json:"keyword_template_id,omitempty"`
+}
+
+// AssignVariant deterministically buckets a visitor into one of the
+// experiment's variants by weight, so the same visitor always gets the same
+// variant for as long as the experiment's variants are unchanged.
+func (e *Experiment) AssignVariant(visitorKey string) (ExperimentVariant, bool) {
+	total := 0
+	for _, v := range e.Variants {
+		if v.Weight > 0 {
+			total += v.Weight
+		}
+	}
+	if total == 0 {
+		return ExperimentVariant{}, false
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(e.ID + ":" + visitorKey))
+	bucket := int(h.Sum32() % uint32(total))
+
+	for _, v := range e.Variants {
+		if v.Weight <= 0 {
+			continue
+		}
+		if bucket < v.Weight {
+			return v, true
+		}
+		bucket -= v.Weight
+	}
+	return ExperimentVariant{}, false
+}
+
+// Variant looks a variant up by id.
+func (e *Experiment) Variant(id string) (ExperimentVariant, bool) {
+	for _, v := range e.Variants {
+		if v.ID == id && v.Weight > 0 {
+			return v, true
+		}
+	}
+	return ExperimentVariant{}, false
+}
+
+// WithVariant returns the action with the variant's overrides applied.
+func (a RuleAction) WithVariant(v ExperimentVariant) RuleAction {
+	if v.SerpTemplateID != "" {
+		a.SerpTemplateID = v.SerpTemplateID
+	}
+	if v.KeywordTemplateID != "" {
+		a.KeywordTemplateID = v.KeywordTemplateID
+	}
+	return a
+}
@@ -0,0 +1,62 @@
+package config
+
+import "strings"
+
+// RuleEvaluation records how one rule fared during resolution.
+type RuleEvaluation struct {
+	RuleID   int    `json:"rule_id"`
+	RuleName string `json:"rule_name"`
+	Priority int    `json:"priority"`
+	Matched  bool   `json:"matched"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// RuleExplanation is the outcome of GetRuleForRequest together with the
+// evaluation of every rule the publisher has.
+type RuleExplanation struct {
+	Source     string           `json:"source"`
+	Considered []RuleEvaluation `json:"considered"`
+	Matched    Rule             `json:"matched_rule"`
+	IsDefault  bool             `json:"is_default"`
+}
+
+// ExplainRule resolves a rule exactly like GetRuleForRequest and reports
+// why each of the publisher's rules was or was not chosen.
+func ExplainRule(ctx RuleContext) RuleExplanation {
+	ex := RuleExplanation{Matched: DefaultRule, IsDefault: true}
+
+	switch {
+	case ctx.PublisherID == 0:
+		ex.Source = "default: no publisher id"
+		return ex
+	case rulesDBConn == nil:
+		ex.Source = "default: no rules database"
+		return ex
+	}
+
+	ctx.CountryCode = strings.ToUpper(strings.TrimSpace(ctx.CountryCode))
+
+	rules, source, err := publisherRules(ctx.PublisherID)
+	if err != nil {
+		ex.Source = "default: rule lookup error: " + err.Error()
+		return ex
+	}
+	ex.Source = source
+
+	found := false
+	for _, rule := range rules {
+		ev := RuleEvaluation{RuleID: rule.ID, RuleName: rule.RuleName, Priority: rule.Priority}
+		if found {
+			ev.Reason = "not evaluated: a higher-priority rule matched"
+		} else if ok, failed := rule.Matches(ctx); ok {
+			ev.Matched = true
+			ex.Matched = rule
+			ex.IsDefault = false
+			found = true
+		} else {
+			ev.Reason = "condition not met: " + failed
+		}
+		ex.Considered = append(ex.Considered, ev)
+	}
+	return ex
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// PartnerParams are the attribution and feature-flag query parameters sent
+// to the keyword API. In an override, an empty value removes the parameter.
+type PartnerParams map[string]string
+
+// DefaultPartnerParams is the built-in profile. The publisher_partner_params
+// row with publisher_id 0 overrides it globally, a publisher's own row
+// overrides that, and a rule action's partner_params override everything.
+// The source tags (pstag, stags) attribute revenue, so they have no built-in
+// value and are only sent once a profile sets them.
+var DefaultPartnerParams = PartnerParams{
+	"https": "1",
+
+	"csid":      "8CUJM46V5",
+	"pid":       "8POJDA6W3",
+	"partnerid": "7PRFT79UO",
+	"fpid":      "800015395",
+	"crid":      "849176236",
+
+	"combineExpired": "1",
+	"fm_skc":         "1",
+	"lmsc":           "1",
+	"hs":             "3",
+	"kf":             "0",
+	"kwrd":           "0",
+	"py":             "1",
+	"pt":             "60",
+	"uftr":           "0",
+	"ugd":            "4",
+	"ykf":            "1",
+	"stag_tq_block":  "1",
+	"calling_source": "cm",
+
+	"mtags": "{perform,BT1_sp},{sem,app,dmsedo,mva,stm,conndigi,pdeal,audext,conn,ginsu}",
+}
+
+// PartnerParamsFor merges the layered partner profiles for a publisher and
+// the rule action that matched the request.
+func PartnerParamsFor(publisherID int, action RuleAction) PartnerParams {
+	merged := PartnerParams{}
+	overlay := func(p PartnerParams) {
+		for k, v := range p {
+			if v == "" {
+				delete(merged, k)
+			} else {
+				merged[k] = v
+			}
+		}
+	}
+
+	overlay(DefaultPartnerParams)
+	global, own := store.partnerParams(publisherID)
+	overlay(global)
+	overlay(own)
+	overlay(action.PartnerParams)
+	return merged
+}
+
+// loadPartnerParams reads every publisher's partner profile.
+func loadPartnerParams() (map[int]PartnerParams, error) {
+	rows, err := rulesDBConn.Query(`SELECT publisher_id, CAST(params AS CHAR) FROM publisher_partner_params`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	profiles := make(map[int]PartnerParams)
+	for rows.Next() {
+		var publisherID int
+		var paramsJSON string
+		if err := rows.Scan(&publisherID, &paramsJSON); err != nil {
+			return nil, err
+		}
+		var p PartnerParams
+		if err := json.Unmarshal([]byte(paramsJSON), &p); err != nil {
+			log.Printf("partner params JSON parse error for publisher %d: %v", publisherID, err)
+			continue
+		}
+		profiles[publisherID] = p
+	}
+	return profiles, rows.Err()
+}
@@ -4,27 +4,101 @@ import (
 	"database/sql"
 	"encoding/json"
 	"log"
+	"strings"
+	"time"
 )
 
 type RuleAction struct {
 	SerpTemplateID    string `json:"serp_template_id"`
 	KeywordTemplateID string `json:"keyword_template_id"`
-	Block             bool   `json:"block"`
-	OpenInNewTab      bool   `json:"open_in_new_tab"`
+	LayoutID          int    `json:"layout_id,omitempty"`
+	TemplateSize      string `json:"template_size,omitempty"`
+	// AllowParamOverride lets the lid/tsize request params replace
+	// LayoutID/TemplateSize; otherwise the rule's values win.
+	AllowParamOverride bool        `json:"allow_param_override,omitempty"`
+	Block              bool        `json:"block"`
+	OpenInNewTab       bool        `json:"open_in_new_tab"`
+	Experiment         *Experiment `json:"experiment,omitempty"`
+	// KeywordProvider names the keyword source: "api" (default), "static"
+	// or "curated".
+	KeywordProvider string `json:"keyword_provider,omitempty"`
+	// PartnerParams override the publisher's keyword API partner profile.
+	PartnerParams PartnerParams `json:"partner_params,omitempty"`
+	// ThrottlePercent (0-100) sheds that share of traffic; QPSCap limits the
+	// publisher's sustained requests per second. Shed requests get
+	// ThrottleFallback, one of the ThrottleFallback* values.
+	ThrottlePercent  int     `json:"throttle_percent,omitempty"`
+	QPSCap           float64 `json:"qps_cap,omitempty"`
+	ThrottleFallback string  `json:"throttle_fallback,omitempty"`
+	// AdProviders are the ad feeds auctioned for the SERP; empty means the
+	// Yahoo feed alone.
+	AdProviders []AdProviderWeight `json:"ad_providers,omitempty"`
+	// Ad clicks scoring at least InvalidClickScore (0 means
+	// DefaultInvalidClickScore) are stored as invalid. InvalidClickAction,
+	// one of the InvalidClick* values, says whether they are still
+	// redirected.
+	InvalidClickScore  int    `json:"invalid_click_score,omitempty"`
+	InvalidClickAction string `json:"invalid_click_action,omitempty"`
+}
+
+// AdProviderWeight enables one ad feed for a rule. Weight multiplies the
+// feed's bids when ads are ranked and breaks ties between feeds that report
+// no bid.
+type AdProviderWeight struct {
+	Name   string  `json:"name"`
+	Weight float64 `json:"weight"`
+}
+
+const (
+	ThrottleFallbackDummy = "dummy"
+	ThrottleFallbackEmpty = "empty"
+	ThrottleFallbackHouse = "house"
+)
+
+const (
+	InvalidClickRedirect = "redirect"
+	InvalidClickReject   = "reject"
+)
+
+// DefaultInvalidClickScore is the click score from which a click is invalid
+// unless the rule sets its own.
+const DefaultInvalidClickScore = 60
+
+// InvalidClickPolicy returns the rule's click score threshold and what to
+// do with invalid clicks, with defaults applied.
+func (a RuleAction) InvalidClickPolicy() (int, string) {
+	score, action := a.InvalidClickScore, a.InvalidClickAction
+	if score <= 0 {
+		score = DefaultInvalidClickScore
+	}
+	if action == "" {
+		action = InvalidClickRedirect
+	}
+	return score, action
 }
 
 type Rule struct {
-	ID          int
-	RuleName    string
-	Action      RuleAction
-	PublisherID int
-	UserAgent   string
-	CountryCode string
+	ID          int            `json:"id"`
+	RuleName    string         `json:"rule_name"`
+	Action      RuleAction     `json:"action"`
+	PublisherID int            `json:"publisher_id"`
+	UserAgent   string         `json:"user_agent"`
+	CountryCode string         `json:"country_code"`
+	Priority    int            `json:"priority"`
+	Conditions  RuleConditions `json:"conditions"`
+	Enabled     bool           `json:"enabled"`
+
+	badConditions bool
+	// rawConditions is the stored conditions JSON when it could not be read.
+	rawConditions string
+	location      *time.Location
 }
 
 var DefaultRuleAction = RuleAction{
 	SerpTemplateID:    "SerpTemplate1.html",
 	KeywordTemplateID: "KeywordTemplate1.html",
+	LayoutID:          224,
+	TemplateSize:      "300x250",
 	Block:             false,
 	OpenInNewTab:      false,
 }
@@ -33,6 +107,7 @@ var DefaultRule = Rule{
 	RuleName:    "default",
 	Action:      DefaultRuleAction,
 	CountryCode: "US",
+	Enabled:     true,
 }
 
 var rulesDBConn *sql.DB
@@ -41,67 +116,123 @@ func SetRulesDB(db *sql.DB) {
 	rulesDBConn = db
 }
 
-func GetRuleByPublisherID(publisherID int) Rule {
-	if publisherID == 0 || rulesDBConn == nil {
-		return DefaultRule
+const ruleColumns = `id, rule_name, action, publisher_id, COALESCE(user_agent, ''), COALESCE(country_code, ''),
+	priority, COALESCE(CAST(conditions AS CHAR), ''), enabled`
+
+func scanRules(rows *sql.Rows) ([]Rule, error) {
+	defer rows.Close()
+
+	var rules []Rule
+	for rows.Next() {
+		var rule Rule
+		var actionJSON, conditionsJSON string
+		if err := rows.Scan(&rule.ID, &rule.RuleName, &actionJSON, &rule.PublisherID, &rule.UserAgent, &rule.CountryCode,
+			&rule.Priority, &conditionsJSON, &rule.Enabled); err != nil {
+			return nil, err
+		}
+		parseRuleJSON(&rule, actionJSON, conditionsJSON)
+		rules = append(rules, rule)
 	}
+	return rules, rows.Err()
+}
 
-	var rule Rule
-	var actionJSON string
-	err := rulesDBConn.QueryRow(`
-		SELECT id, rule_name, action, publisher_id, COALESCE(user_agent, ''), COALESCE(country_code, 'US')
-		FROM rules WHERE publisher_id = ? AND (user_agent IS NULL OR user_agent = '') LIMIT 1
-	`, publisherID).Scan(&rule.ID, &rule.RuleName, &actionJSON, &rule.PublisherID, &rule.UserAgent, &rule.CountryCode)
-
+// LoadPublisherRules reads every rule of a publisher from the database,
+// sorted by priority.
+func LoadPublisherRules(publisherID int) ([]Rule, error) {
+	rows, err := rulesDBConn.Query(`SELECT `+ruleColumns+` FROM rules WHERE publisher_id = ?`, publisherID)
 	if err != nil {
-		return DefaultRule
+		return nil, err
+	}
+	rules, err := scanRules(rows)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := json.Unmarshal([]byte(actionJSON), &rule.Action); err != nil {
-		log.Printf("action JSON parse error: %v", err)
-		rule.Action = DefaultRuleAction
+	var tz string
+	if err := rulesDBConn.QueryRow(`SELECT timezone FROM publisher WHERE publisher_id = ?`, publisherID).Scan(&tz); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	loc := loadLocation(publisherID, tz)
+	for i := range rules {
+		rules[i].location = loc
 	}
-	return rule
+
+	SortRules(rules)
+	return rules, nil
 }
 
-func GetRuleByPublisherIDAndUserAgent(publisherID int, userAgent string) Rule {
-	if publisherID == 0 || rulesDBConn == nil {
+// GetRuleForRequest evaluates the publisher's rules in priority order and
+// returns the first whose conditions all match, or DefaultRule. Rules come
+// from the in-memory store once it has loaded; until then the database is
+// queried directly.
+func GetRuleForRequest(ctx RuleContext) Rule {
+	if ctx.PublisherID == 0 || rulesDBConn == nil {
+		return DefaultRule
+	}
+
+	ctx.CountryCode = strings.ToUpper(strings.TrimSpace(ctx.CountryCode))
+
+	rules, _, err := publisherRules(ctx.PublisherID)
+	if err != nil {
+		log.Printf("rule lookup error: %v", err)
 		return DefaultRule
 	}
+	return SelectRule(rules, ctx)
+}
 
-	var rule Rule
-	var actionJSON string
-	err := rulesDBConn.QueryRow(`
-		SELECT id, rule_name, action, publisher_id, COALESCE(user_agent, ''), COALESCE(country_code, 'US')
-		FROM rules WHERE publisher_id = ? AND user_agent != '' AND ? LIKE CONCAT('%', user_agent, '%')
-		ORDER BY LENGTH(user_agent) DESC LIMIT 1
-	`, publisherID, userAgent).Scan(&rule.ID, &rule.RuleName, &actionJSON, &rule.PublisherID, &rule.UserAgent, &rule.CountryCode)
+// publisherRules returns a publisher's rules from the in-memory store, or
+// from the database until the store has loaded, and names the source used.
+func publisherRules(publisherID int) ([]Rule, string, error) {
+	if rules, loaded := store.get(publisherID); loaded {
+		return rules, "memory", nil
+	}
+	rules, err := LoadPublisherRules(publisherID)
+	return rules, "database", err
+}
 
+// loadLocation resolves a publisher's IANA time zone, defaulting to UTC.
+func loadLocation(publisherID int, tz string) *time.Location {
+	if tz == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(tz)
 	if err != nil {
-		return GetRuleByPublisherID(publisherID)
+		log.Printf("publisher %d: invalid timezone %q, using UTC", publisherID, tz)
+		return time.UTC
 	}
+	return loc
+}
 
+func parseRuleJSON(rule *Rule, actionJSON, conditionsJSON string) {
 	if err := json.Unmarshal([]byte(actionJSON), &rule.Action); err != nil {
 		log.Printf("action JSON parse error: %v", err)
 		rule.Action = DefaultRuleAction
 	}
-	return rule
+	if conditionsJSON != "" {
+		if err := json.Unmarshal([]byte(conditionsJSON), &rule.Conditions); err != nil {
+			log.Printf("conditions JSON parse error on rule %d: %v", rule.ID, err)
+			rule.badConditions = true
+			rule.rawConditions = conditionsJSON
+		}
+	}
 }
 
+// UpsertRule creates the rule or, if the publisher already has a rule with
+// the same name, replaces it. Both paths are recorded in rule history.
 func UpsertRule(rule Rule) error {
 	if rulesDBConn == nil {
 		return nil
 	}
 
-	actionJSON, err := json.Marshal(rule.Action)
-	if err != nil {
-		return err
+	var id int
+	err := rulesDBConn.QueryRow(`SELECT id FROM rules WHERE publisher_id = ? AND rule_name = ?`,
+		rule.PublisherID, rule.RuleName).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = CreateRule(rule, "system")
+	case err == nil:
+		rule.ID = id
+		_, err = UpdateRule(rule, "system")
 	}
-
-	_, err = rulesDBConn.Exec(`
-		INSERT INTO rules (rule_name, action, publisher_id, user_agent, country_code) VALUES (?, ?, ?, ?, ?)
-		ON DUPLICATE KEY UPDATE rule_name = VALUES(rule_name), action = VALUES(action), user_agent = VALUES(user_agent), country_code = VALUES(country_code)
-	`, rule.RuleName, string(actionJSON), rule.PublisherID, rule.UserAgent, rule.CountryCode)
-
 	return err
 }
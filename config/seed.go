@@ -0,0 +1,137 @@
+package config
+
+// SeedRule is a rule row inserted when the rules table is empty. Action is
+// the stored JSON, so fields the engine does not read yet are kept.
+type SeedRule struct {
+	RuleName    string
+	Action      string
+	PublisherID int
+	UserAgent   string
+	CountryCode string
+	Priority    int
+}
+
+// SeedRules are the rules a new install starts with: a catch-all default
+// plus Android, Googlebot and generic bot rules for each demo publisher.
+var SeedRules = []SeedRule{
+	{
+		RuleName: "publisher_100_default",
+		Action: `{
+			"serp_template_id": "SerpTemplate2.html",
+			"keyword_template_id": "KeywordTemplate1.html",
+			"layout_id": 224,
+			"template_size": "300x250",
+			"block": false,
+			"open_in_new_tab": false
+		}`,
+		PublisherID: 100,
+		UserAgent:   "",
+		CountryCode: "",
+		Priority:    0,
+	},
+	{
+		RuleName: "publisher_100_android",
+		Action: `{
+			"serp_template_id": "SerpTemplate2.html",
+			"keyword_template_id": "KeywordTemplate1.html",
+			"layout_id": 224,
+			"template_size": "300x250",
+			"block": false,
+			"open_in_new_tab": true
+		}`,
+		PublisherID: 100,
+		UserAgent:   "Android",
+		CountryCode: "US",
+		Priority:    20,
+	},
+	{
+		RuleName: "publisher_100_googlebot",
+		Action: `{
+			"serp_template_id": "SerptemplateBot.html",
+			"keyword_template_id": "KeywordTemplateBot.html",
+			"layout_id": 224,
+			"template_size": "300x250",
+			"block": false,
+			"open_in_new_tab": true
+		}`,
+		PublisherID: 100,
+		UserAgent:   "Googlebot",
+		CountryCode: "US",
+		Priority:    30,
+	},
+	{
+		RuleName: "publisher_100_bot",
+		Action: `{
+			"serp_template_id": "SerptemplateBot.html",
+			"keyword_template_id": "KeywordTemplateBot.html",
+			"layout_id": 224,
+			"template_size": "300x250",
+			"block": false,
+			"open_in_new_tab": false
+		}`,
+		PublisherID: 100,
+		UserAgent:   "bot",
+		CountryCode: "US",
+		Priority:    10,
+	},
+	{
+		RuleName: "publisher_200_default",
+		Action: `{
+			"serp_template_id": "SerpTemplate3.html",
+			"keyword_template_id": "KeywordTemplate3.html",
+			"layout_id": 224,
+			"template_size": "300x250",
+			"block": false,
+			"open_in_new_tab": false
+		}`,
+		PublisherID: 200,
+		UserAgent:   "",
+		CountryCode: "",
+		Priority:    0,
+	},
+	{
+		RuleName: "publisher_200_android",
+		Action: `{
+			"serp_template_id": "SerpTemplate3.html",
+			"keyword_template_id": "KeywordTemplate3.html",
+			"layout_id": 224,
+			"template_size": "300x250",
+			"block": false,
+			"open_in_new_tab": true
+		}`,
+		PublisherID: 200,
+		UserAgent:   "Android",
+		CountryCode: "US",
+		Priority:    20,
+	},
+	{
+		RuleName: "publisher_200_googlebot",
+		Action: `{
+			"serp_template_id": "SerptemplateBot.html",
+			"keyword_template_id": "KeywordTemplateBot.html",
+			"layout_id": 224,
+			"template_size": "300x250",
+			"block": false,
+			"open_in_new_tab": true
+		}`,
+		PublisherID: 200,
+		UserAgent:   "Googlebot",
+		CountryCode: "US",
+		Priority:    30,
+	},
+	{
+		RuleName: "publisher_200_bot",
+		Action: `{
+			"serp_template_id": "SerptemplateBot.html",
+			"keyword_template_id": "KeywordTemplateBot.html",
+			"layout_id": 224,
+			"template_size": "300x250",
+			"block": false,
+			"open_in_new_tab": false
+		}`,
+		PublisherID: 200,
+		UserAgent:   "bot",
+		CountryCode: "US",
+		Priority:    10,
+	},
+}
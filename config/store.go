@@ -0,0 +1,172 @@
+package config
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// ruleStore is the in-process index of rules and partner parameter profiles
+// by publisher. It is replaced wholesale on every successful reload, so
+// readers never see a partial set, and it is kept as-is when the database
+// cannot be reached.
+type ruleStore struct {
+	mu          sync.RWMutex
+	loaded      bool
+	byPublisher map[int][]Rule
+	partner     map[int]PartnerParams
+	fingerprint string
+}
+
+var store = &ruleStore{}
+
+func (s *ruleStore) get(publisherID int) ([]Rule, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byPublisher[publisherID], s.loaded
+}
+
+// partnerParams returns the global (publisher 0) and the publisher's own
+// partner profiles.
+func (s *ruleStore) partnerParams(publisherID int) (PartnerParams, PartnerParams) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.partner[0], s.partner[publisherID]
+}
+
+func (s *ruleStore) replace(byPublisher map[int][]Rule, partner map[int]PartnerParams, fingerprint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byPublisher = byPublisher
+	s.partner = partner
+	s.fingerprint = fingerprint
+	s.loaded = true
+}
+
+func (s *ruleStore) currentFingerprint() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fingerprint
+}
+
+// rulesFingerprint summarises the rules, partner params and publisher
+// tables so the poller can tell whether anything changed without reading
+// every row. Each table contributes its row count and the XOR of a CRC of
+// every row, so edits within the same second, or to a publisher's time zone,
+// change it too.
+func rulesFingerprint() (string, error) {
+	var rules, partner, publishers string
+	err := rulesDBConn.QueryRow(`
+		SELECT
+			(SELECT CONCAT(COUNT(*), '/', COALESCE(BIT_XOR(CRC32(CONCAT_WS('|', id, rule_name, action, publisher_id,
+				user_agent, country_code, priority, CAST(conditions AS CHAR), enabled, updated_at))), 0)) FROM rules),
+			(SELECT CONCAT(COUNT(*), '/', COALESCE(BIT_XOR(CRC32(CONCAT_WS('|', publisher_id, params))), 0))
+				FROM publisher_partner_params),
+			(SELECT CONCAT(COUNT(*), '/', COALESCE(BIT_XOR(CRC32(CONCAT_WS('|', publisher_id, timezone))), 0))
+				FROM publisher)
+	`).Scan(&rules, &partner, &publishers)
+	if err != nil {
+		return "", err
+	}
+	return rules + "|" + partner + "|" + publishers, nil
+}
+
+// ReloadRules reads the whole rules and partner params tables into memory.
+// On error the last known good rule set stays in place.
+func ReloadRules() error {
+	if rulesDBConn == nil {
+		return nil
+	}
+
+	fingerprint, err := rulesFingerprint()
+	if err != nil {
+		return err
+	}
+
+	rows, err := rulesDBConn.Query(`SELECT ` + ruleColumns + ` FROM rules`)
+	if err != nil {
+		return err
+	}
+	all, err := scanRules(rows)
+	if err != nil {
+		return err
+	}
+
+	locations, err := publisherLocations()
+	if err != nil {
+		return err
+	}
+
+	byPublisher := make(map[int][]Rule)
+	for _, rule := range all {
+		rule.location = locations[rule.PublisherID]
+		byPublisher[rule.PublisherID] = append(byPublisher[rule.PublisherID], rule)
+	}
+	for _, rules := range byPublisher {
+		SortRules(rules)
+	}
+	partner, err := loadPartnerParams()
+	if err != nil {
+		return err
+	}
+
+	store.replace(byPublisher, partner, fingerprint)
+	return nil
+}
+
+func publisherLocations() (map[int]*time.Location, error) {
+	rows, err := rulesDBConn.Query(`SELECT publisher_id, timezone FROM publisher`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locations := make(map[int]*time.Location)
+	for rows.Next() {
+		var publisherID int
+		var tz string
+		if err := rows.Scan(&publisherID, &tz); err != nil {
+			return nil, err
+		}
+		locations[publisherID] = loadLocation(publisherID, tz)
+	}
+	return locations, rows.Err()
+}
+
+// StartRuleReloader loads the rules once and then keeps them fresh: every
+// pollInterval it reloads if the table fingerprint changed, and every
+// refreshInterval it reloads unconditionally, until ctx is done.
+func StartRuleReloader(ctx context.Context, pollInterval, refreshInterval time.Duration) {
+	if err := ReloadRules(); err != nil {
+		log.Printf("initial rule load error: %v", err)
+	}
+
+	go func() {
+		poll := time.NewTicker(pollInterval)
+		refresh := time.NewTicker(refreshInterval)
+		defer poll.Stop()
+		defer refresh.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-poll.C:
+				fingerprint, err := rulesFingerprint()
+				if err != nil {
+					log.Printf("rule poll error: %v, keeping last known rules", err)
+					continue
+				}
+				if fingerprint == store.currentFingerprint() {
+					continue
+				}
+			case <-refresh.C:
+			}
+
+			if err := ReloadRules(); err != nil {
+				log.Printf("rule reload error: %v, keeping last known rules", err)
+			}
+		}
+	}()
+}
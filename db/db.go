@@ -7,6 +7,8 @@ import (
 	"regexp"
 	"strings"
 
+	"adserving/config"
+
 	_ "github.com/go-sql-driver/mysql"
 )
 
@@ -93,6 +95,7 @@ func createTables() error {
 		`CREATE TABLE IF NOT EXISTS publisher (
 			publisher_id INT PRIMARY KEY,
 			domain VARCHAR(255) NOT NULL,
+			timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 		)`,
@@ -103,11 +106,62 @@ func createTables() error {
 			action JSON NOT NULL,
 			publisher_id INT NOT NULL,
 			user_agent VARCHAR(255) DEFAULT NULL,
-			country_code VARCHAR(10) DEFAULT 'US',
+			country_code VARCHAR(10) DEFAULT '',
+			priority INT NOT NULL DEFAULT 0,
+			conditions JSON DEFAULT NULL,
+			enabled TINYINT(1) NOT NULL DEFAULT 1,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 			UNIQUE KEY unique_publisher_rule (publisher_id, rule_name)
 		)`,
+		// Rule history - one row per rule mutation, for audit and rollback
+		`CREATE TABLE IF NOT EXISTS rule_history (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			rule_id INT NOT NULL,
+			version INT NOT NULL,
+			operation VARCHAR(20) NOT NULL,
+			actor VARCHAR(255) NOT NULL,
+			before_state JSON DEFAULT NULL,
+			after_state JSON DEFAULT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY unique_rule_version (rule_id, version)
+		)`,
+		// Publisher partner params - keyword API attribution and feature flags
+		// per publisher; publisher_id 0 is the global default profile
+		`CREATE TABLE IF NOT EXISTS publisher_partner_params (
+			publisher_id INT PRIMARY KEY,
+			params JSON NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		)`,
+		// Curated keyword - hand-picked keywords for the "curated" provider;
+		// publisher_id 0 rows apply to every publisher
+		`CREATE TABLE IF NOT EXISTS curated_keyword (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			publisher_id INT NOT NULL DEFAULT 0,
+			keyword VARCHAR(500) NOT NULL,
+			country_code VARCHAR(10) DEFAULT NULL,
+			priority INT NOT NULL DEFAULT 0,
+			enabled TINYINT(1) NOT NULL DEFAULT 1,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			INDEX idx_publisher_id (publisher_id)
+		)`,
+		// Throttle event - requests shed by a rule's throttle percent or QPS cap
+		`CREATE TABLE IF NOT EXISTS throttle_event (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			publisher_id INT NOT NULL,
+			rule_id INT,
+			endpoint VARCHAR(50),
+			reason VARCHAR(20),
+			fallback VARCHAR(20),
+			client_ip VARCHAR(100),
+			user_agent TEXT,
+			country_code VARCHAR(10),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_publisher_id (publisher_id),
+			INDEX idx_created_at (created_at)
+		)`,
 		// Keyword impression - records when keywords are shown on publisher page
 		`CREATE TABLE IF NOT EXISTS keyword_impression (
 			id INT AUTO_INCREMENT PRIMARY KEY,
@@ -118,8 +172,13 @@ func createTables() error {
 			client_ip VARCHAR(100),
 			user_agent TEXT,
 			country_code VARCHAR(10),
+			experiment_id VARCHAR(64) DEFAULT NULL,
+			variant_id VARCHAR(64) DEFAULT NULL,
+			render_id CHAR(32) DEFAULT NULL,
+			sig_verdict VARCHAR(16) DEFAULT NULL,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			INDEX idx_publisher_id (publisher_id),
+			INDEX idx_render_id (render_id),
 			INDEX idx_created_at (created_at)
 		)`,
 		// Keyword click - records when a keyword is clicked (redirects to SERP)
@@ -132,9 +191,16 @@ func createTables() error {
 			client_ip VARCHAR(100),
 			user_agent TEXT,
 			country_code VARCHAR(10),
+			experiment_id VARCHAR(64) DEFAULT NULL,
+			variant_id VARCHAR(64) DEFAULT NULL,
+			render_id CHAR(32) DEFAULT NULL,
+			serp_id CHAR(32) DEFAULT NULL,
+			sig_verdict VARCHAR(16) DEFAULT NULL,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			INDEX idx_publisher_id (publisher_id),
 			INDEX idx_keyword_id (keyword_id),
+			INDEX idx_render_id (render_id),
+			INDEX idx_serp_id (serp_id),
 			INDEX idx_created_at (created_at)
 		)`,
 		// Ad impression - records when ads are shown on SERP page
@@ -144,14 +210,23 @@ func createTables() error {
 			keyword_id INT,
 			keyword_title VARCHAR(500),
 			ad_position INT,
+			provider_rank INT DEFAULT NULL,
 			ad_title VARCHAR(500),
 			ad_host VARCHAR(255),
+			ad_provider VARCHAR(32) DEFAULT NULL,
 			client_ip VARCHAR(100),
 			user_agent TEXT,
 			country_code VARCHAR(10),
+			experiment_id VARCHAR(64) DEFAULT NULL,
+			variant_id VARCHAR(64) DEFAULT NULL,
+			render_id CHAR(32) DEFAULT NULL,
+			serp_id CHAR(32) DEFAULT NULL,
+			sig_verdict VARCHAR(16) DEFAULT NULL,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			INDEX idx_publisher_id (publisher_id),
 			INDEX idx_keyword_id (keyword_id),
+			INDEX idx_render_id (render_id),
+			INDEX idx_serp_id (serp_id),
 			INDEX idx_created_at (created_at)
 		)`,
 		// Ad click - records when an ad is clicked on SERP page
@@ -160,16 +235,31 @@ func createTables() error {
 			publisher_id INT NOT NULL,
 			keyword_id INT,
 			keyword_title VARCHAR(500),
+			ad_position INT DEFAULT NULL,
+			provider_rank INT DEFAULT NULL,
 			ad_title VARCHAR(500),
 			ad_host VARCHAR(255),
+			ad_provider VARCHAR(32) DEFAULT NULL,
+			sitelink_position INT DEFAULT NULL,
 			ad_target_url TEXT,
 			slot VARCHAR(100),
 			client_ip VARCHAR(100),
 			user_agent TEXT,
 			country_code VARCHAR(10),
+			experiment_id VARCHAR(64) DEFAULT NULL,
+			variant_id VARCHAR(64) DEFAULT NULL,
+			render_id CHAR(32) DEFAULT NULL,
+			serp_id CHAR(32) DEFAULT NULL,
+			sig_verdict VARCHAR(16) DEFAULT NULL,
+			click_score INT NOT NULL DEFAULT 0,
+			click_reasons VARCHAR(255) DEFAULT NULL,
+			is_invalid TINYINT(1) NOT NULL DEFAULT 0,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			INDEX idx_publisher_id (publisher_id),
 			INDEX idx_keyword_id (keyword_id),
+			INDEX idx_render_id (render_id),
+			INDEX idx_serp_id (serp_id),
+			INDEX idx_is_invalid (is_invalid),
 			INDEX idx_created_at (created_at)
 		)`,
 	}
@@ -182,6 +272,10 @@ func createTables() error {
 
 	log.Println("Ensured all tables exist")
 
+	if err := migrateTables(); err != nil {
+		return fmt.Errorf("failed to migrate tables: %w", err)
+	}
+
 	// Seed publishers
 	if err := seedPublishers(); err != nil {
 		return fmt.Errorf("failed to seed publishers: %w", err)
@@ -190,6 +284,175 @@ func createTables() error {
 	return nil
 }
 
+// trackingTables are the event tables written by the ad handlers
+var trackingTables = []string{"keyword_impression", "keyword_click", "ad_impression", "ad_click"}
+
+// migrateTables adds columns introduced after a table was first created.
+func migrateTables() error {
+	added, err := ensureColumn("rules", "priority", "INT NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	if added {
+		// Preserve the old precedence for existing rows: country-specific
+		// before any-country, UA rules before defaults, longer UA first.
+		_, err := DB.Exec(`
+			UPDATE rules SET priority =
+				IF(COALESCE(country_code, '') IN ('', '*'), 0, 1000) +
+				IF(COALESCE(user_agent, '') = '', 0, 100 + CHAR_LENGTH(user_agent))
+		`)
+		if err != nil {
+			return fmt.Errorf("failed to backfill rule priority: %w", err)
+		}
+	}
+
+	// Seeded catch-all rules used to be US-only, so other countries fell
+	// through to the global default; the column default changes with them,
+	// which also marks this as done.
+	changed, err := ensureColumnDefault("rules", "country_code", "VARCHAR(10) DEFAULT ''", "")
+	if err != nil {
+		return err
+	}
+	if changed {
+		for _, seed := range config.SeedRules {
+			if seed.CountryCode != "" {
+				continue
+			}
+			_, err := DB.Exec(`
+				UPDATE rules SET country_code = ''
+				WHERE publisher_id = ? AND rule_name = ? AND COALESCE(user_agent, '') = '' AND country_code = 'US'
+			`, seed.PublisherID, seed.RuleName)
+			if err != nil {
+				return fmt.Errorf("failed to normalise seeded rule %s: %w", seed.RuleName, err)
+			}
+		}
+	}
+
+	if _, err := ensureColumn("rules", "conditions", "JSON DEFAULT NULL"); err != nil {
+		return err
+	}
+	if _, err := ensureColumn("rules", "enabled", "TINYINT(1) NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	if _, err := ensureColumn("publisher", "timezone", "VARCHAR(64) NOT NULL DEFAULT 'UTC'"); err != nil {
+		return err
+	}
+
+	for _, table := range trackingTables {
+		if _, err := ensureColumn(table, "experiment_id", "VARCHAR(64) DEFAULT NULL"); err != nil {
+			return err
+		}
+		if _, err := ensureColumn(table, "variant_id", "VARCHAR(64) DEFAULT NULL"); err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"ad_impression", "ad_click"} {
+		if _, err := ensureColumn(table, "ad_provider", "VARCHAR(32) DEFAULT NULL"); err != nil {
+			return err
+		}
+	}
+	if _, err := ensureColumn("ad_click", "sitelink_position", "INT DEFAULT NULL"); err != nil {
+		return err
+	}
+	if _, err := ensureColumn("ad_click", "ad_position", "INT DEFAULT NULL"); err != nil {
+		return err
+	}
+	for _, table := range []string{"ad_impression", "ad_click"} {
+		if _, err := ensureColumn(table, "provider_rank", "INT DEFAULT NULL"); err != nil {
+			return err
+		}
+	}
+
+	// Funnel ids: render_id everywhere, serp_id from the keyword click on
+	for _, table := range trackingTables {
+		columns := []string{"render_id", "serp_id"}
+		if table == "keyword_impression" {
+			columns = columns[:1]
+		}
+		for _, column := range columns {
+			added, err := ensureColumn(table, column, "CHAR(32) DEFAULT NULL")
+			if err != nil {
+				return err
+			}
+			if added {
+				if _, err := DB.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD INDEX `idx_%s` (`%s`)", table, column, column)); err != nil {
+					return fmt.Errorf("failed to index %s.%s: %w", table, column, err)
+				}
+			}
+		}
+	}
+
+	// Outcome of the tracking link signature check
+	for _, table := range trackingTables {
+		if _, err := ensureColumn(table, "sig_verdict", "VARCHAR(16) DEFAULT NULL"); err != nil {
+			return err
+		}
+	}
+
+	// Click quality assessment
+	if _, err := ensureColumn("ad_click", "click_score", "INT NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if _, err := ensureColumn("ad_click", "click_reasons", "VARCHAR(255) DEFAULT NULL"); err != nil {
+		return err
+	}
+	added, err = ensureColumn("ad_click", "is_invalid", "TINYINT(1) NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	if added {
+		if _, err := DB.Exec("ALTER TABLE ad_click ADD INDEX idx_is_invalid (is_invalid)"); err != nil {
+			return fmt.Errorf("failed to index ad_click.is_invalid: %w", err)
+		}
+	}
+	return nil
+}
+
+// ensureColumn adds a column to a table if it does not already exist and
+// reports whether it was added
+func ensureColumn(table, column, definition string) (bool, error) {
+	var count int
+	err := DB.QueryRow(`
+		SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?
+	`, table, column).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect %s.%s: %w", table, column, err)
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	if _, err := DB.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` %s", table, column, definition)); err != nil {
+		return false, fmt.Errorf("failed to add %s.%s: %w", table, column, err)
+	}
+	log.Printf("Added column %s.%s", table, column)
+	return true, nil
+}
+
+// ensureColumnDefault redefines a column whose default is not def yet and
+// reports whether it did.
+func ensureColumnDefault(table, column, definition, def string) (bool, error) {
+	var current sql.NullString
+	err := DB.QueryRow(`
+		SELECT COLUMN_DEFAULT FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?
+	`, table, column).Scan(&current)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect %s.%s: %w", table, column, err)
+	}
+	// MariaDB reports string defaults quoted
+	if current.Valid && (current.String == def || current.String == "'"+def+"'") {
+		return false, nil
+	}
+
+	if _, err := DB.Exec(fmt.Sprintf("ALTER TABLE `%s` MODIFY COLUMN `%s` %s", table, column, definition)); err != nil {
+		return false, fmt.Errorf("failed to change %s.%s: %w", table, column, err)
+	}
+	log.Printf("Changed default of %s.%s", table, column)
+	return true, nil
+}
+
 // seedPublishers seeds the publisher table with known publishers
 func seedPublishers() error {
 	publishers := []struct {
@@ -229,136 +492,15 @@ func seedRules() error {
 	}
 
 	// Table is empty, seed default rules
-	rules := []struct {
-		ruleName    string
-		action      string
-		publisherID int
-		userAgent   string
-		countryCode string
-	}{
-		{
-			ruleName: "publisher_100_default",
-			action: `{
-				"serp_template_id": "SerpTemplate2.html",
-				"keyword_template_id": "KeywordTemplate1.html",
-				"layout_id": 224,
-				"template_size": "300x250",
-				"block": false,
-				"open_in_new_tab": false
-			}`,
-			publisherID: 100,
-			userAgent:   "",
-			countryCode: "US",
-		},
-		{
-			ruleName: "publisher_100_android",
-			action: `{
-				"serp_template_id": "SerpTemplate2.html",
-				"keyword_template_id": "KeywordTemplate1.html",
-				"layout_id": 224,
-				"template_size": "300x250",
-				"block": false,
-				"open_in_new_tab": true
-			}`,
-			publisherID: 100,
-			userAgent:   "Android",
-			countryCode: "US",
-		},
-		{
-			ruleName: "publisher_100_googlebot",
-			action: `{
-				"serp_template_id": "SerptemplateBot.html",
-				"keyword_template_id": "KeywordTemplateBot.html",
-				"layout_id": 224,
-				"template_size": "300x250",
-				"block": false,
-				"open_in_new_tab": true
-			}`,
-			publisherID: 100,
-			userAgent:   "Googlebot",
-			countryCode: "US",
-		},
-		{
-			ruleName: "publisher_100_bot",
-			action: `{
-				"serp_template_id": "SerptemplateBot.html",
-				"keyword_template_id": "KeywordTemplateBot.html",
-				"layout_id": 224,
-				"template_size": "300x250",
-				"block": false,
-				"open_in_new_tab": false
-			}`,
-			publisherID: 100,
-			userAgent:   "bot",
-			countryCode: "US",
-		},
-		{
-			ruleName: "publisher_200_default",
-			action: `{
-				"serp_template_id": "SerpTemplate3.html",
-				"keyword_template_id": "KeywordTemplate3.html",
-				"layout_id": 224,
-				"template_size": "300x250",
-				"block": false,
-				"open_in_new_tab": false
-			}`,
-			publisherID: 200,
-			userAgent:   "",
-			countryCode: "US",
-		},
-		{
-			ruleName: "publisher_200_android",
-			action: `{
-				"serp_template_id": "SerpTemplate3.html",
-				"keyword_template_id": "KeywordTemplate3.html",
-				"layout_id": 224,
-				"template_size": "300x250",
-				"block": false,
-				"open_in_new_tab": true
-			}`,
-			publisherID: 200,
-			userAgent:   "Android",
-			countryCode: "US",
-		},
-		{
-			ruleName: "publisher_200_googlebot",
-			action: `{
-				"serp_template_id": "SerptemplateBot.html",
-				"keyword_template_id": "KeywordTemplateBot.html",
-				"layout_id": 224,
-				"template_size": "300x250",
-				"block": false,
-				"open_in_new_tab": true
-			}`,
-			publisherID: 200,
-			userAgent:   "Googlebot",
-			countryCode: "US",
-		},
-		{
-			ruleName: "publisher_200_bot",
-			action: `{
-				"serp_template_id": "SerptemplateBot.html",
-				"keyword_template_id": "KeywordTemplateBot.html",
-				"layout_id": 224,
-				"template_size": "300x250",
-				"block": false,
-				"open_in_new_tab": false
-			}`,
-			publisherID: 200,
-			userAgent:   "bot",
-			countryCode: "US",
-		},
-	}
-
-	for _, rule := range rules {
+	for _, rule := range config.SeedRules {
 		_, err := DB.Exec(`
-			INSERT INTO rules (rule_name, action, publisher_id, user_agent, country_code)
-			VALUES (?, ?, ?, ?, ?)
-		`, rule.ruleName, rule.action, rule.publisherID, rule.userAgent, rule.countryCode)
+			INSERT INTO rules (rule_name, action, publisher_id, user_agent, country_code, priority)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, rule.RuleName, rule.Action, rule.PublisherID, rule.UserAgent, rule.CountryCode, rule.Priority)
 		if err != nil {
-			return fmt.Errorf("failed to seed rule %s: %w", rule.ruleName, err)
+			return fmt.Errorf("failed to seed rule %s: %w", rule.RuleName, err)
 		}
-		log.Printf("Seeded rule: %s for publisher_id %d", rule.ruleName, rule.publisherID)
+		log.Printf("Seeded rule: %s for publisher_id %d", rule.RuleName, rule.PublisherID)
 	}
 
 	log.Println("Rules seeding complete")
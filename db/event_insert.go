@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"net"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// unavailableMySQLErrors are server errors that say the database cannot take
+// writes right now, rather than that the rows are bad.
+var unavailableMySQLErrors = map[uint16]bool{
+	1040: true, // too many connections
+	1053: true, // server shutdown in progress
+	1205: true, // lock wait timeout
+	1213: true, // deadlock
+	1290: true, // running with --read-only
+	1836: true, // read-only mode
+}
+
+// isUnavailable reports whether err means the database could not be reached
+// or could not write at all, so the rows are worth keeping for later. Any
+// other error is about the rows themselves and retrying them will not help.
+func isUnavailable(err error) bool {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		return unavailableMySQLErrors[myErr.Number]
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr)
+}
+
+// writeRecord inserts rec as one batch. When the database rejects the batch
+// for its data, the rows are retried one at a time so a bad row cannot hold
+// back the rest; rows rejected on their own are passed to quarantine. It
+// returns the rows written and, if the database became unavailable, the
+// error along with the rows not yet written.
+func writeRecord(ctx context.Context, conn *sql.DB, rec SpoolRecord, quarantine func(SpoolRecord, error)) (int, SpoolRecord, error) {
+	query, args := rec.insertSQL()
+	_, err := conn.ExecContext(ctx, query, args...)
+	if err == nil {
+		return len(rec.Rows), SpoolRecord{}, nil
+	}
+	if isUnavailable(err) || len(rec.Rows) == 0 {
+		return 0, rec, err
+	}
+	log.Printf("%s batch of %d rows rejected: %v, retrying row by row", rec.Table, len(rec.Rows), err)
+
+	written := 0
+	for i := range rec.Rows {
+		row := SpoolRecord{Table: rec.Table, Columns: rec.Columns, Rows: rec.Rows[i : i+1], At: rec.At[i : i+1]}
+		query, args := row.insertSQL()
+		_, err := conn.ExecContext(ctx, query, args...)
+		switch {
+		case err == nil:
+			written++
+		case isUnavailable(err):
+			rest := SpoolRecord{Table: rec.Table, Columns: rec.Columns, Rows: rec.Rows[i:], At: rec.At[i:]}
+			return written, rest, err
+		default:
+			eventStats.Add("quarantined", 1)
+			quarantine(row, err)
+		}
+	}
+	return written, SpoolRecord{}, nil
+}
@@ -0,0 +1,229 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+)
+
+// eventStats is published at /debug/vars as "events".
+var eventStats = expvar.NewMap("events")
+
+// Queue policies for when the event queue is full.
+const (
+	// EventPolicyDrop discards the event at once.
+	EventPolicyDrop = "drop"
+	// EventPolicyBlock makes the handler wait up to BlockTimeout for room
+	// before discarding the event.
+	EventPolicyBlock = "block"
+)
+
+type EventWriterOptions struct {
+	QueueSize     int
+	Workers       int
+	BatchSize     int
+	FlushInterval time.Duration
+	Policy        string
+	BlockTimeout  time.Duration
+	// Spool, if set, keeps batches the database rejects; nil drops them.
+	Spool *Spool
+}
+
+// EventWriter moves tracking rows off the request path: events go into a
+// bounded queue and a pool of workers writes them with multi-row inserts,
+// one per table, whenever a batch fills up or FlushInterval passes.
+type EventWriter struct {
+	conn  *sql.DB
+	opts  EventWriterOptions
+	queue chan queuedEvent
+	wg    sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+type queuedEvent struct {
+	event Event
+	at    time.Time
+}
+
+func NewEventWriter(conn *sql.DB, opts EventWriterOptions) *EventWriter {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1
+	}
+	w := &EventWriter{
+		conn:  conn,
+		opts:  opts,
+		queue: make(chan queuedEvent, opts.QueueSize),
+	}
+	for i := 0; i < opts.Workers; i++ {
+		w.wg.Add(1)
+		go w.worker()
+	}
+	return w
+}
+
+// Enqueue queues ev for writing and reports whether it was accepted. A full
+// queue is handled by the writer's policy; events after Close are dropped.
+func (w *EventWriter) Enqueue(ev Event) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		eventStats.Add("dropped_closed", 1)
+		return false
+	}
+
+	qe := queuedEvent{event: ev, at: time.Now()}
+	select {
+	case w.queue <- qe:
+		eventStats.Add("enqueued", 1)
+		return true
+	default:
+	}
+
+	if w.opts.Policy == EventPolicyBlock && w.opts.BlockTimeout > 0 {
+		timer := time.NewTimer(w.opts.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case w.queue <- qe:
+			eventStats.Add("enqueued", 1)
+			eventStats.Add("blocked", 1)
+			return true
+		case <-timer.C:
+		}
+	}
+
+	eventStats.Add("dropped_full", 1)
+	return false
+}
+
+// Close stops accepting events and waits for the workers to write what is
+// queued, or for ctx to end.
+func (w *EventWriter) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *EventWriter) worker() {
+	defer w.wg.Done()
+
+	batches := make(map[string][]queuedEvent)
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+
+	flushAll := func() {
+		for table, batch := range batches {
+			if len(batch) > 0 {
+				w.flush(table, batch)
+				batches[table] = batch[:0]
+			}
+		}
+	}
+
+	for {
+		select {
+		case qe, ok := <-w.queue:
+			if !ok {
+				flushAll()
+				return
+			}
+			table := qe.event.eventTable()
+			batches[table] = append(batches[table], qe)
+			if len(batches[table]) >= w.opts.BatchSize {
+				w.flush(table, batches[table])
+				batches[table] = batches[table][:0]
+			}
+		case <-ticker.C:
+			flushAll()
+		}
+	}
+}
+
+// flush writes one table's batch in a single INSERT. When the database is
+// unavailable, or earlier batches are still spooled, the batch goes to the
+// spool instead. Rows the database rejects for their data are quarantined.
+func (w *EventWriter) flush(table string, batch []queuedEvent) {
+	rec := recordFor(table, batch)
+	spool := w.opts.Spool
+
+	if spool == nil || !spool.Pending() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		n, rest, err := writeRecord(ctx, w.conn, rec, w.quarantine)
+		cancel()
+		eventStats.Add("written", int64(n))
+		if err == nil {
+			eventStats.Add("batches", 1)
+			return
+		}
+		log.Printf("%s batch insert failed, database unavailable: %v", table, err)
+		rec = rest
+	}
+
+	if spool == nil {
+		eventStats.Add("failed", int64(len(rec.Rows)))
+		return
+	}
+	if err := spool.Append(rec); err != nil {
+		eventStats.Add("failed", int64(len(rec.Rows)))
+		log.Printf("%s batch of %d rows lost, spool append failed: %v", table, len(rec.Rows), err)
+		return
+	}
+	eventStats.Add("spooled", int64(len(rec.Rows)))
+}
+
+func (w *EventWriter) quarantine(rec SpoolRecord, cause error) {
+	if w.opts.Spool != nil {
+		w.opts.Spool.quarantine(rec, cause)
+		return
+	}
+	eventStats.Add("failed", int64(len(rec.Rows)))
+	log.Printf("%s: %d rejected rows dropped: %v", rec.Table, len(rec.Rows), cause)
+}
+
+var events *EventWriter
+
+// StartEventWriter starts the process-wide event writer used by
+// RecordEvent. Init must have been called.
+func StartEventWriter(opts EventWriterOptions) {
+	events = NewEventWriter(DB, opts)
+}
+
+// RecordEvent queues a tracking row. It never blocks longer than the
+// writer's policy allows, and drops the event if no writer is running.
+func RecordEvent(ev Event) {
+	if events == nil {
+		eventStats.Add("dropped_closed", 1)
+		return
+	}
+	events.Enqueue(ev)
+}
+
+// StopEventWriter drains the event writer; see EventWriter.Close.
+func StopEventWriter(ctx context.Context) error {
+	if events == nil {
+		return nil
+	}
+	return events.Close(ctx)
+}
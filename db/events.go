@@ -0,0 +1,152 @@
+package db
+
+import "adserving/utils"
+
+// Event is one row destined for a tracking table. Handlers build the typed
+// events below and hand them to RecordEvent; the event writer batches them
+// per table.
+type Event interface {
+	eventTable() string
+	eventRow() []any
+}
+
+// eventColumns lists, per table, the columns eventRow values are in. The
+// writer appends created_at, the time the event was recorded, since rows
+// reach the table some time later.
+var eventColumns = map[string][]string{
+	"keyword_impression": {"render_id", "publisher_id", "keyword_id", "keyword_title", "slot", "client_ip", "user_agent", "country_code", "experiment_id", "variant_id", "sig_verdict"},
+	"keyword_click":      {"render_id", "serp_id", "publisher_id", "keyword_id", "keyword_title", "slot", "client_ip", "user_agent", "country_code", "experiment_id", "variant_id", "sig_verdict"},
+	"ad_impression":      {"render_id", "serp_id", "publisher_id", "keyword_id", "keyword_title", "ad_position", "provider_rank", "ad_title", "ad_host", "ad_provider", "client_ip", "user_agent", "country_code", "experiment_id", "variant_id", "sig_verdict"},
+	"ad_click":           {"render_id", "serp_id", "publisher_id", "keyword_id", "keyword_title", "ad_position", "provider_rank", "ad_title", "ad_host", "ad_provider", "sitelink_position", "ad_target_url", "slot", "client_ip", "user_agent", "country_code", "experiment_id", "variant_id", "sig_verdict", "click_score", "click_reasons", "is_invalid"},
+	"throttle_event":     {"publisher_id", "rule_id", "endpoint", "reason", "fallback", "client_ip", "user_agent", "country_code"},
+}
+
+// Visitor holds the request fields every tracking row carries.
+type Visitor struct {
+	ClientIP    string
+	UserAgent   string
+	CountryCode string
+}
+
+// Trace links a row to the keyword render (RenderID) and SERP view (SerpID)
+// it came from, so impressions and clicks can be joined into a funnel.
+type Trace struct {
+	RenderID string
+	SerpID   string
+}
+
+// Variant is the experiment arm a request was served, empty outside
+// experiments.
+type Variant struct {
+	ExperimentID string
+	VariantID    string
+}
+
+type KeywordImpression struct {
+	RenderID     string
+	PublisherID  int
+	KeywordID    int // 0 is stored as NULL
+	KeywordTitle string
+	Slot         string
+	Visitor
+	Variant
+	// SigVerdict is the result of checking the signature of the link the
+	// event came in on (services.Verdict*)
+	SigVerdict string
+}
+
+func (e KeywordImpression) eventTable() string { return "keyword_impression" }
+
+func (e KeywordImpression) eventRow() []any {
+	return []any{utils.NullIfEmpty(e.RenderID), e.PublisherID, utils.NullIfZero(e.KeywordID), e.KeywordTitle, e.Slot,
+		e.ClientIP, e.UserAgent, e.CountryCode, utils.NullIfEmpty(e.ExperimentID), utils.NullIfEmpty(e.VariantID), utils.NullIfEmpty(e.SigVerdict)}
+}
+
+type KeywordClick struct {
+	Trace
+	PublisherID  int
+	KeywordID    int
+	KeywordTitle string
+	Slot         string
+	Visitor
+	Variant
+	SigVerdict string
+}
+
+func (e KeywordClick) eventTable() string { return "keyword_click" }
+
+func (e KeywordClick) eventRow() []any {
+	return []any{utils.NullIfEmpty(e.RenderID), utils.NullIfEmpty(e.SerpID), e.PublisherID, e.KeywordID, e.KeywordTitle, e.Slot,
+		e.ClientIP, e.UserAgent, e.CountryCode, utils.NullIfEmpty(e.ExperimentID), utils.NullIfEmpty(e.VariantID), utils.NullIfEmpty(e.SigVerdict)}
+}
+
+type AdImpression struct {
+	Trace
+	PublisherID  int
+	KeywordID    int
+	KeywordTitle string
+	Position     int
+	ProviderRank int // 0 is stored as NULL
+	AdTitle      string
+	AdHost       string
+	AdProvider   string
+	Visitor
+	Variant
+	SigVerdict string
+}
+
+func (e AdImpression) eventTable() string { return "ad_impression" }
+
+func (e AdImpression) eventRow() []any {
+	return []any{utils.NullIfEmpty(e.RenderID), utils.NullIfEmpty(e.SerpID), e.PublisherID, e.KeywordID, e.KeywordTitle, e.Position, utils.NullIfZero(e.ProviderRank),
+		e.AdTitle, e.AdHost, utils.NullIfEmpty(e.AdProvider),
+		e.ClientIP, e.UserAgent, e.CountryCode, utils.NullIfEmpty(e.ExperimentID), utils.NullIfEmpty(e.VariantID), utils.NullIfEmpty(e.SigVerdict)}
+}
+
+type AdClick struct {
+	Trace
+	PublisherID  int
+	KeywordID    int
+	KeywordTitle string
+	Position     int // 0 (unknown) is stored as NULL, as are the next two
+	ProviderRank int
+	Sitelink     int
+	AdTitle      string
+	AdHost       string
+	AdProvider   string
+	TargetURL    string
+	Slot         string
+	Visitor
+	Variant
+	SigVerdict string
+	// ClickScore (0-100) and ClickReasons are the click quality assessment;
+	// Invalid clicks scored at or above the rule's threshold.
+	ClickScore   int
+	ClickReasons string
+	Invalid      bool
+}
+
+func (e AdClick) eventTable() string { return "ad_click" }
+
+func (e AdClick) eventRow() []any {
+	return []any{utils.NullIfEmpty(e.RenderID), utils.NullIfEmpty(e.SerpID), e.PublisherID, e.KeywordID, e.KeywordTitle, utils.NullIfZero(e.Position), utils.NullIfZero(e.ProviderRank),
+		e.AdTitle, e.AdHost, utils.NullIfEmpty(e.AdProvider), utils.NullIfZero(e.Sitelink), e.TargetURL, e.Slot,
+		e.ClientIP, e.UserAgent, e.CountryCode, utils.NullIfEmpty(e.ExperimentID), utils.NullIfEmpty(e.VariantID), utils.NullIfEmpty(e.SigVerdict),
+		e.ClickScore, utils.NullIfEmpty(e.ClickReasons), e.Invalid}
+}
+
+type ThrottleEvent struct {
+	PublisherID int
+	RuleID      int
+	Endpoint    string
+	Reason      string
+	Fallback    string
+	Visitor
+}
+
+func (e ThrottleEvent) eventTable() string { return "throttle_event" }
+
+func (e ThrottleEvent) eventRow() []any {
+	return []any{e.PublisherID, e.RuleID, e.Endpoint, e.Reason, e.Fallback,
+		e.ClientIP, e.UserAgent, e.CountryCode}
+}
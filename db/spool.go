@@ -0,0 +1,360 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A spool segment is a file named events-<seq>.spool holding the magic
+// bytes followed by records, each framed as
+//
+//	uint32 payload length | uint32 CRC-32C of payload | JSON SpoolRecord
+//
+// big-endian. Segments are only ever appended to; a record cut short by a
+// crash shows up as a torn tail and ends the segment.
+const (
+	spoolMagic        = "ASP1"
+	spoolPrefix       = "events-"
+	spoolSuffix       = ".spool"
+	spoolOffsetSuffix = ".offset"
+	spoolBadSuffix    = ".bad"
+	spoolQuarantine   = "quarantine.jsonl"
+	maxSpoolRecord    = 64 << 20
+)
+
+var spoolCRC = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ErrSpoolTorn     = errors.New("spool record truncated")
+	ErrSpoolChecksum = errors.New("spool record checksum mismatch")
+)
+
+// SpoolRecord is one batch of rows for a table that could not be written.
+// Columns exclude created_at; At holds each row's created_at in Unix
+// nanoseconds.
+type SpoolRecord struct {
+	Table   string   `json:"table"`
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+	At      []int64  `json:"at"`
+}
+
+// Spool is a directory of append-only segments holding tracking rows
+// written while the database was unavailable.
+type Spool struct {
+	dir          string
+	segmentBytes int64
+
+	mu         sync.Mutex
+	active     *os.File
+	activeSize int64
+	nextSeq    int
+	pending    bool
+}
+
+// OpenSpool opens (creating if needed) the spool in dir. Segments are
+// rotated once they reach segmentBytes.
+func OpenSpool(dir string, segmentBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, segmentBytes: segmentBytes, nextSeq: 1}
+	segments, err := s.Segments()
+	if err != nil {
+		return nil, err
+	}
+	if n := len(segments); n > 0 {
+		s.nextSeq = segmentSeq(segments[n-1]) + 1
+		s.pending = true
+	}
+	return s, nil
+}
+
+func (s *Spool) Dir() string { return s.dir }
+
+// Pending reports whether the spool holds rows not yet replayed. While it
+// does, new rows are spooled too so they reach the database in order.
+func (s *Spool) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// Append durably adds rec to the active segment.
+func (s *Spool) Append(rec SpoolRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.appendLocked(rec)
+}
+
+// appendLocked is Append with s.mu held.
+func (s *Spool) appendLocked(rec SpoolRecord) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, spoolCRC))
+	frame = append(frame, payload...)
+
+	if s.active == nil {
+		if err := s.openSegment(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.active.Write(frame); err != nil {
+		return err
+	}
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+	s.pending = true
+	s.activeSize += int64(len(frame))
+	if s.activeSize >= s.segmentBytes {
+		return s.sealLocked()
+	}
+	return nil
+}
+
+// Quarantine appends rows the database rejected for their data, with the
+// error, to quarantine.jsonl in the spool directory. They are kept for
+// inspection and are never replayed.
+func (s *Spool) Quarantine(rec SpoolRecord, cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.quarantineLocked(rec, cause)
+}
+
+// quarantineLocked is Quarantine with s.mu held.
+func (s *Spool) quarantineLocked(rec SpoolRecord, cause error) error {
+	line, err := json.Marshal(struct {
+		Error  string      `json:"error"`
+		Record SpoolRecord `json:"record"`
+	}{cause.Error(), rec})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.dir, spoolQuarantine), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// quarantine is Quarantine for writeRecord, logging rows it cannot keep.
+func (s *Spool) quarantine(rec SpoolRecord, cause error) {
+	keepQuarantined(rec, s.Quarantine(rec, cause))
+}
+
+// quarantineHeld is quarantine with s.mu held.
+func (s *Spool) quarantineHeld(rec SpoolRecord, cause error) {
+	keepQuarantined(rec, s.quarantineLocked(rec, cause))
+}
+
+func keepQuarantined(rec SpoolRecord, err error) {
+	if err != nil {
+		eventStats.Add("failed", int64(len(rec.Rows)))
+		log.Printf("%s: %d rejected rows lost, quarantine failed: %v", rec.Table, len(rec.Rows), err)
+	}
+}
+
+// openSegment starts a new segment. s.mu must be held.
+func (s *Spool) openSegment() error {
+	name := filepath.Join(s.dir, fmt.Sprintf("%s%010d%s", spoolPrefix, s.nextSeq, spoolSuffix))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(spoolMagic)); err != nil {
+		f.Close()
+		return err
+	}
+	s.active = f
+	s.activeSize = int64(len(spoolMagic))
+	s.nextSeq++
+	return nil
+}
+
+// sealLocked closes the active segment so the next Append starts another.
+// s.mu must be held.
+func (s *Spool) sealLocked() error {
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.active = nil
+	return err
+}
+
+// Close seals the active segment.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sealLocked()
+}
+
+// Segments returns the paths of the spool's segments, oldest first.
+// Segments set aside as corrupt are not included.
+func (s *Spool) Segments() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasPrefix(name, spoolPrefix) && strings.HasSuffix(name, spoolSuffix) && segmentSeq(name) > 0 {
+			segments = append(segments, filepath.Join(s.dir, name))
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segmentSeq(segments[i]) < segmentSeq(segments[j]) })
+	return segments, nil
+}
+
+func segmentSeq(path string) int {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), spoolPrefix), spoolSuffix)
+	n, err := strconv.Atoi(name)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// ReadSegment calls fn for each record of the segment at path, starting at
+// byte offset (0 for the beginning). fn receives the offset just past the
+// record. Reading stops at the first error from fn; a torn or corrupt
+// record ends it with ErrSpoolTorn or ErrSpoolChecksum.
+func ReadSegment(path string, offset int64, fn func(rec SpoolRecord, next int64) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(spoolMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != spoolMagic {
+		return fmt.Errorf("%s: missing segment header: %w", path, ErrSpoolTorn)
+	}
+	if offset < int64(len(spoolMagic)) {
+		offset = int64(len(spoolMagic))
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("%s at %d: %w", path, offset, ErrSpoolTorn)
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		if size > maxSpoolRecord {
+			return fmt.Errorf("%s at %d: %w", path, offset, ErrSpoolChecksum)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return fmt.Errorf("%s at %d: %w", path, offset, ErrSpoolTorn)
+		}
+		if crc32.Checksum(payload, spoolCRC) != binary.BigEndian.Uint32(header[4:8]) {
+			return fmt.Errorf("%s at %d: %w", path, offset, ErrSpoolChecksum)
+		}
+
+		var rec SpoolRecord
+		dec := json.NewDecoder(bytes.NewReader(payload))
+		dec.UseNumber()
+		if err := dec.Decode(&rec); err != nil {
+			return fmt.Errorf("%s at %d: %w", path, offset, err)
+		}
+
+		offset += 8 + int64(size)
+		if err := fn(rec, offset); err != nil {
+			return err
+		}
+	}
+}
+
+// recordFor converts a batch from the event writer.
+func recordFor(table string, batch []queuedEvent) SpoolRecord {
+	rec := SpoolRecord{Table: table, Columns: eventColumns[table]}
+	for _, qe := range batch {
+		rec.Rows = append(rec.Rows, qe.event.eventRow())
+		rec.At = append(rec.At, qe.at.UnixNano())
+	}
+	return rec
+}
+
+// validate checks a record read back from disk before it becomes SQL: the
+// table and columns must be ones the event writer produces.
+func (rec SpoolRecord) validate() error {
+	known, ok := eventColumns[rec.Table]
+	if !ok {
+		return fmt.Errorf("unknown table %q", rec.Table)
+	}
+	for _, c := range rec.Columns {
+		found := false
+		for _, k := range known {
+			if c == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown column %s.%s", rec.Table, c)
+		}
+	}
+	if len(rec.At) != len(rec.Rows) {
+		return fmt.Errorf("%d rows but %d timestamps", len(rec.Rows), len(rec.At))
+	}
+	for _, row := range rec.Rows {
+		if len(row) != len(rec.Columns) {
+			return fmt.Errorf("row has %d values for %d columns", len(row), len(rec.Columns))
+		}
+	}
+	return nil
+}
+
+// insertSQL builds the multi-row INSERT for a record.
+func (rec SpoolRecord) insertSQL() (string, []any) {
+	placeholder := "(" + strings.Repeat("?, ", len(rec.Columns)) + "?)"
+
+	var sb strings.Builder
+	sb.WriteString("INSERT INTO " + rec.Table + " (" + strings.Join(rec.Columns, ", ") + ", created_at) VALUES ")
+	args := make([]any, 0, len(rec.Rows)*(len(rec.Columns)+1))
+	for i, row := range rec.Rows {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(placeholder)
+		args = append(args, row...)
+		args = append(args, time.Unix(0, rec.At[i]))
+	}
+	return sb.String(), args
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errBadRecord = errors.New("invalid spool record")
+
+// maxReplayPasses bounds the catch-up passes Replay makes before draining
+// the rest with writers held back.
+const maxReplayPasses = 5
+
+// Replay writes the spooled records to conn, oldest first, deleting each
+// segment once all of it is written. Progress within a segment is kept in
+// a .offset file next to it, so a record is replayed again only if the
+// process dies between its INSERT and the offset update. Segments with a
+// torn or corrupt record are renamed to .bad after their good records are
+// written. Rows the database rejects for their data are quarantined and
+// replay moves past them; it stops when the database becomes unavailable
+// and returns the number of rows written.
+//
+// Writers keep spooling while a replay runs, so Replay catches up on what
+// they added until little is left, then drains that tail holding s.mu and
+// clears pending in the same step. From then on new rows go straight to
+// the database.
+func (s *Spool) Replay(ctx context.Context, conn *sql.DB) (int, error) {
+	rows := 0
+	for pass := 0; pass < maxReplayPasses; pass++ {
+		// Seal the active segment so writers move on to a new one while
+		// this replays everything before it.
+		s.mu.Lock()
+		err := s.sealLocked()
+		limit := s.nextSeq
+		s.mu.Unlock()
+		if err != nil {
+			return rows, err
+		}
+
+		n, segments, err := s.replaySegments(ctx, conn, limit, s.Append, s.quarantine)
+		rows += n
+		if err != nil {
+			return rows, err
+		}
+		if segments <= 1 {
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.sealLocked(); err != nil {
+		return rows, err
+	}
+	n, _, err := s.replaySegments(ctx, conn, s.nextSeq, s.appendLocked, s.quarantineHeld)
+	rows += n
+	if err != nil {
+		return rows, err
+	}
+	s.pending = false
+	return rows, nil
+}
+
+// replaySegments replays the segments numbered below limit, passing rows
+// left over by a failed write to appendRest and rejected rows to
+// quarantine. It returns the rows written and the segments it went through.
+func (s *Spool) replaySegments(ctx context.Context, conn *sql.DB, limit int,
+	appendRest func(SpoolRecord) error, quarantine func(SpoolRecord, error)) (int, int, error) {
+	segments, err := s.Segments()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rows, replayed := 0, 0
+	for _, seg := range segments {
+		if segmentSeq(seg) >= limit {
+			break
+		}
+		n, err := replaySegment(ctx, conn, seg, appendRest, quarantine)
+		rows += n
+		replayed++
+		eventStats.Add("replayed", int64(n))
+
+		switch {
+		case errors.Is(err, ErrSpoolTorn), errors.Is(err, ErrSpoolChecksum), errors.Is(err, errBadRecord):
+			log.Printf("spool segment set aside: %v", err)
+			eventStats.Add("spool_bad_segments", 1)
+			os.Remove(seg + spoolOffsetSuffix)
+			if err := os.Rename(seg, seg+spoolBadSuffix); err != nil {
+				return rows, replayed, err
+			}
+		case err != nil:
+			return rows, replayed, err
+		default:
+			os.Remove(seg + spoolOffsetSuffix)
+			if err := os.Remove(seg); err != nil {
+				return rows, replayed, err
+			}
+		}
+	}
+	return rows, replayed, nil
+}
+
+func replaySegment(ctx context.Context, conn *sql.DB, seg string,
+	appendRest func(SpoolRecord) error, quarantine func(SpoolRecord, error)) (int, error) {
+	offset, err := readSpoolOffset(seg)
+	if err != nil {
+		return 0, err
+	}
+
+	rows := 0
+	err = ReadSegment(seg, offset, func(rec SpoolRecord, next int64) error {
+		if err := rec.validate(); err != nil {
+			return fmt.Errorf("%s before %d: %v: %w", seg, next, err, errBadRecord)
+		}
+		n, rest, err := writeRecord(ctx, conn, rec, quarantine)
+		rows += n
+		if err != nil {
+			if len(rest.Rows) == len(rec.Rows) {
+				return err
+			}
+			// Part of the record is written; keep only the rest so it is
+			// not written twice
+			if appendErr := appendRest(rest); appendErr != nil {
+				return appendErr
+			}
+		}
+		if werr := os.WriteFile(seg+spoolOffsetSuffix, []byte(strconv.FormatInt(next, 10)), 0o644); werr != nil {
+			return werr
+		}
+		return err
+	})
+	return rows, err
+}
+
+func readSpoolOffset(seg string) (int64, error) {
+	b, err := os.ReadFile(seg + spoolOffsetSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// StartReplayer replays the spool every interval, once the database answers
+// a ping, until ctx is done.
+func (s *Spool) StartReplayer(ctx context.Context, conn *sql.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if !s.Pending() {
+				continue
+			}
+
+			pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			err := conn.PingContext(pingCtx)
+			cancel()
+			if err != nil {
+				continue
+			}
+
+			n, err := s.Replay(ctx, conn)
+			if err != nil {
+				log.Printf("spool replay stopped after %d rows: %v", n, err)
+			} else if n > 0 {
+				log.Printf("spool replay wrote %d rows", n)
+			}
+		}
+	}()
+}
+
+// SegmentInfo summarises one spool segment for inspection.
+type SegmentInfo struct {
+	Path     string         `json:"path"`
+	Bytes    int64          `json:"bytes"`
+	Records  int            `json:"records"`
+	Rows     map[string]int `json:"rows"`
+	First    time.Time      `json:"first,omitempty"`
+	Last     time.Time      `json:"last,omitempty"`
+	Replayed int64          `json:"replayed_offset,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// InspectSegment reads a segment (or a segment set aside as .bad) without
+// modifying it, calling fn, if not nil, for each record.
+func InspectSegment(path string, fn func(SpoolRecord)) SegmentInfo {
+	info := SegmentInfo{Path: path, Rows: make(map[string]int)}
+	if st, err := os.Stat(path); err == nil {
+		info.Bytes = st.Size()
+	}
+	info.Replayed, _ = readSpoolOffset(path)
+
+	err := ReadSegment(path, 0, func(rec SpoolRecord, _ int64) error {
+		info.Records++
+		info.Rows[rec.Table] += len(rec.Rows)
+		for _, at := range rec.At {
+			t := time.Unix(0, at)
+			if info.First.IsZero() || t.Before(info.First) {
+				info.First = t
+			}
+			if t.After(info.Last) {
+				info.Last = t
+			}
+		}
+		if fn != nil {
+			fn(rec)
+		}
+		return nil
+	})
+	if err != nil {
+		info.Error = err.Error()
+	}
+	return info
+}
@@ -0,0 +1,285 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// fakeDB is a database/sql driver that accepts inserts, rejects any row
+// holding "POISON" the way MySQL rejects bad data, and fails every call with
+// driver.ErrBadConn while down.
+type fakeDB struct {
+	mu     sync.Mutex
+	down   bool
+	rows   []string // keyword_title of every inserted row
+	onExec func()   // run once, before the next insert
+}
+
+var (
+	fakeDBsMu sync.Mutex
+	fakeDBs   = map[string]*fakeDB{}
+)
+
+func init() {
+	sql.Register("eventtest", fakeDriver{})
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBsMu.Lock()
+	defer fakeDBsMu.Unlock()
+	return fakeConn{fakeDBs[name]}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) { return nil, errors.New("not supported") }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	hook := s.db.onExec
+	s.db.onExec = nil
+	s.db.mu.Unlock()
+	if hook != nil {
+		hook()
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.db.down {
+		return nil, driver.ErrBadConn
+	}
+
+	// keyword_impression rows: keyword_title is the fourth of 12 values
+	const perRow = 12
+	var titles []string
+	for i := 0; i+perRow <= len(args); i += perRow {
+		title, _ := args[i+3].(string)
+		if title == "POISON" {
+			return nil, &mysql.MySQLError{Number: 1366, Message: "Incorrect string value"}
+		}
+		titles = append(titles, title)
+	}
+	s.db.rows = append(s.db.rows, titles...)
+	return driver.RowsAffected(len(titles)), nil
+}
+
+func (db *fakeDB) setDown(down bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.down = down
+}
+
+func (db *fakeDB) beforeNextExec(fn func()) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.onExec = fn
+}
+
+func (db *fakeDB) inserted() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]string(nil), db.rows...)
+}
+
+func openFakeDB(t *testing.T) (*sql.DB, *fakeDB) {
+	t.Helper()
+	fake := &fakeDB{}
+	fakeDBsMu.Lock()
+	fakeDBs[t.Name()] = fake
+	fakeDBsMu.Unlock()
+
+	conn, err := sql.Open("eventtest", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, fake
+}
+
+func impressionBatch(titles ...string) []queuedEvent {
+	var batch []queuedEvent
+	for _, title := range titles {
+		batch = append(batch, queuedEvent{event: KeywordImpression{PublisherID: 1, KeywordTitle: title}, at: time.Now()})
+	}
+	return batch
+}
+
+func quarantined(t *testing.T, dir string) []string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(dir, spoolQuarantine))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func TestReplayQuarantinesPoisonBatch(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, titles := range [][]string{{"a", "b"}, {"c", "POISON", "d"}, {"e"}, {"f", "g"}} {
+		if err := spool.Append(recordFor("keyword_impression", impressionBatch(titles...))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, fake := openFakeDB(t)
+	n, err := spool.Replay(context.Background(), conn)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if n != 7 {
+		t.Errorf("Replay wrote %d rows, want 7", n)
+	}
+	if got := strings.Join(fake.inserted(), ","); got != "a,b,c,d,e,f,g" {
+		t.Errorf("inserted %s", got)
+	}
+	if q := quarantined(t, dir); len(q) != 1 || !strings.Contains(q[0], "POISON") {
+		t.Errorf("quarantine = %q, want the poison row", q)
+	}
+	if spool.Pending() {
+		t.Error("spool still pending after a full replay")
+	}
+	if segs, _ := spool.Segments(); len(segs) != 0 {
+		t.Errorf("segments left: %v", segs)
+	}
+}
+
+func TestReplayStopsWhileDatabaseDown(t *testing.T) {
+	spool, err := OpenSpool(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(recordFor("keyword_impression", impressionBatch("a", "b"))); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, fake := openFakeDB(t)
+	fake.setDown(true)
+	if n, err := spool.Replay(context.Background(), conn); err == nil || n != 0 {
+		t.Fatalf("Replay while down = %d, %v; want an error", n, err)
+	}
+	if !spool.Pending() {
+		t.Fatal("spool lost its rows while the database was down")
+	}
+
+	fake.setDown(false)
+	if n, err := spool.Replay(context.Background(), conn); err != nil || n != 2 {
+		t.Fatalf("Replay after recovery = %d, %v; want 2 rows", n, err)
+	}
+}
+
+func TestReplayLeavesReplayModeDespiteNewWrites(t *testing.T) {
+	spool, err := OpenSpool(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(recordFor("keyword_impression", impressionBatch("a", "b"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// A writer spools a batch while the replay is running
+	conn, fake := openFakeDB(t)
+	fake.beforeNextExec(func() {
+		if err := spool.Append(recordFor("keyword_impression", impressionBatch("c"))); err != nil {
+			t.Error(err)
+		}
+	})
+	if n, err := spool.Replay(context.Background(), conn); err != nil || n != 3 {
+		t.Fatalf("Replay = %d, %v; want 3 rows", n, err)
+	}
+	if spool.Pending() {
+		t.Fatal("spool still pending after replaying rows written during the replay")
+	}
+
+	// Later batches go straight to the database
+	w := NewEventWriter(conn, EventWriterOptions{QueueSize: 10, Workers: 1, BatchSize: 1, FlushInterval: time.Hour, Spool: spool})
+	w.Enqueue(KeywordImpression{PublisherID: 1, KeywordTitle: "d"})
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if spool.Pending() {
+		t.Error("batch spooled after the replay finished")
+	}
+	if got := strings.Join(fake.inserted(), ","); got != "a,b,c,d" {
+		t.Errorf("inserted %s, want a,b,c,d", got)
+	}
+}
+
+func TestWriterSpoolsOnlyWhenDatabaseUnavailable(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, fake := openFakeDB(t)
+	opts := EventWriterOptions{QueueSize: 10, Workers: 1, BatchSize: 3, FlushInterval: time.Hour, Spool: spool}
+
+	// A data error quarantines the bad row and writes the rest
+	w := NewEventWriter(conn, opts)
+	for _, title := range []string{"a", "POISON", "b"} {
+		w.Enqueue(KeywordImpression{PublisherID: 1, KeywordTitle: title})
+	}
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(fake.inserted(), ","); got != "a,b" {
+		t.Errorf("inserted %s, want a,b", got)
+	}
+	if spool.Pending() {
+		t.Fatal("a data error must not send the batch to the spool")
+	}
+	if q := quarantined(t, dir); len(q) != 1 {
+		t.Errorf("quarantine = %q, want one row", q)
+	}
+
+	// A lost connection spools the batch for replay
+	fake.setDown(true)
+	w = NewEventWriter(conn, opts)
+	for _, title := range []string{"c", "d", "e"} {
+		w.Enqueue(KeywordImpression{PublisherID: 1, KeywordTitle: title})
+	}
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !spool.Pending() {
+		t.Fatal("batch not spooled while the database was down")
+	}
+
+	fake.setDown(false)
+	if n, err := spool.Replay(context.Background(), conn); err != nil || n != 3 {
+		t.Fatalf("Replay = %d, %v; want 3 rows", n, err)
+	}
+	if got := strings.Join(fake.inserted(), ","); got != "a,b,c,d,e" {
+		t.Errorf("inserted %s, want a,b,c,d,e", got)
+	}
+}
@@ -2,10 +2,11 @@ package handlers
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
+	"time"
 
+	"adserving/config"
 	"adserving/db"
 	"adserving/models"
 	"adserving/services"
@@ -14,10 +15,12 @@ import (
 
 type AdClickHandler struct {
 	clickService *services.ClickService
+	signer       *services.URLSigner
+	quality      *services.ClickQuality
 }
 
-func NewAdClickHandler(clickService *services.ClickService) *AdClickHandler {
-	return &AdClickHandler{clickService: clickService}
+func NewAdClickHandler(clickService *services.ClickService, signer *services.URLSigner, quality *services.ClickQuality) *AdClickHandler {
+	return &AdClickHandler{clickService: clickService, signer: signer, quality: quality}
 }
 
 func (h *AdClickHandler) Handle(w http.ResponseWriter, r *http.Request) {
@@ -31,6 +34,14 @@ func (h *AdClickHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// u is covered by the signature, so only a valid link is redirected;
+	// in flag mode other links are still recorded but not followed
+	verdict, ok := h.signer.Check("ad_click", q)
+	if !ok {
+		http.Error(w, "invalid or expired link", http.StatusForbidden)
+		return
+	}
+
 	target, err := utils.SafeTargetURL(targetRaw)
 	if err != nil {
 		http.Error(w, "invalid target", http.StatusBadRequest)
@@ -42,28 +53,99 @@ func (h *AdClickHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	query := q.Get("q")
 	adHost := q.Get("adhost")
 	adTitle := q.Get("adtitle")
+	adProvider := q.Get("prov")
+	sitelink := utils.AtoiOrZero(q.Get("sl"))
+	position := utils.AtoiOrZero(q.Get("pos"))
+	providerRank := utils.AtoiOrZero(q.Get("prank"))
+	trace := db.Trace{RenderID: utils.RequestIDParam(q.Get("rid")), SerpID: utils.RequestIDParam(q.Get("sid"))}
 	countryCode := q.Get("cc")
+	domain := q.Get("d")
 	publisherID := utils.AtoiOrZero(q.Get("pid"))
+	experimentID := q.Get("exp")
+	variantID := q.Get("var")
 	clientIP := utils.GetClientIP(r)
 
-	key := models.ClickStatKey{Slot: slot, KeywordID: strconv.Itoa(keywordID), Query: query, AdHost: adHost}
-	h.clickService.IncrementClick(key)
+	// The signing time of a valid link is when its SERP was served
+	var shownAt time.Time
+	if verdict == services.VerdictValid {
+		if ts, err := strconv.ParseInt(q.Get("ts"), 10, 64); err == nil {
+			shownAt = time.Unix(ts, 0)
+		}
+	}
+	quality := h.quality.Assess(services.ClickSignals{
+		RenderID:    trace.RenderID,
+		SerpID:      trace.SerpID,
+		ClientIP:    clientIP,
+		UserAgent:   userAgent,
+		Ad:          fmt.Sprintf("%d|%d|%s|%s", position, sitelink, adHost, query),
+		ShownAt:     shownAt,
+		LinkVerdict: verdict,
+	})
+
+	// Repeats of a click just logged are sent on without being counted
+	if quality.Duplicate {
+		h.finish(w, r, target, verdict, isBot)
+		return
+	}
+
+	rule := config.GetRuleForRequest(config.RuleContext{
+		PublisherID: publisherID,
+		UserAgent:   userAgent,
+		CountryCode: countryCode,
+		Domain:      domain,
+		Slot:        slot,
+		Referrer:    r.Referer(),
+		Now:         time.Now(),
+	})
+	threshold, invalidAction := rule.Action.InvalidClickPolicy()
+	invalid := quality.Score >= threshold
+
+	if !invalid {
+		key := models.ClickStatKey{Slot: slot, KeywordID: strconv.Itoa(keywordID), Query: query, AdHost: adHost}
+		h.clickService.IncrementClick(key)
+	}
 
 	if publisherID > 0 {
-		_, err := db.GetDB().Exec(
-			`INSERT INTO ad_click (publisher_id, keyword_id, keyword_title, ad_title, ad_host, ad_target_url, slot, client_ip, user_agent, country_code) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-			publisherID, keywordID, query, adTitle, adHost, target, slot, clientIP, userAgent, countryCode,
-		)
-		if err != nil {
-			log.Printf("ad_click insert error: %v", err)
-		}
+		db.RecordEvent(db.AdClick{
+			Trace:        trace,
+			PublisherID:  publisherID,
+			KeywordID:    keywordID,
+			KeywordTitle: query,
+			Position:     position,
+			ProviderRank: providerRank,
+			Sitelink:     sitelink,
+			AdTitle:      adTitle,
+			AdHost:       adHost,
+			AdProvider:   adProvider,
+			TargetURL:    target,
+			Slot:         slot,
+			Visitor:      db.Visitor{ClientIP: clientIP, UserAgent: userAgent, CountryCode: countryCode},
+			Variant:      db.Variant{ExperimentID: experimentID, VariantID: variantID},
+			SigVerdict:   verdict,
+			ClickScore:   quality.Score,
+			ClickReasons: services.JoinClickReasons(quality.Reasons),
+			Invalid:      invalid,
+		})
 	}
 
+	if invalid && invalidAction == config.InvalidClickReject {
+		http.Error(w, "click refused", http.StatusForbidden)
+		return
+	}
+	h.finish(w, r, target, verdict, isBot)
+}
+
+// finish sends the visitor on to target if the link was validly signed;
+// bots get a plain response instead.
+func (h *AdClickHandler) finish(w http.ResponseWriter, r *http.Request, target, verdict string, isBot bool) {
 	if isBot {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprint(w, "Click logged")
 		return
 	}
-
+	if verdict != services.VerdictValid {
+		http.Error(w, "invalid or expired link", http.StatusForbidden)
+		return
+	}
 	http.Redirect(w, r, target, http.StatusFound)
 }
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"adserving/services"
+)
+
+func newTestAdClickHandler(t *testing.T, enforce bool) (*AdClickHandler, *services.URLSigner) {
+	t.Helper()
+	signer, err := services.NewURLSigner([]services.SigningKey{{ID: "k1", Secret: []byte("0123456789abcdef")}}, time.Hour, enforce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAdClickHandler(services.NewClickService(), signer, services.NewClickQuality(services.ClickQualityOptions{})), signer
+}
+
+const browserUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36"
+
+func adClick(h *AdClickHandler, q url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/ad-click?"+q.Encode(), nil)
+	r.Header.Set("User-Agent", browserUA)
+	w := httptest.NewRecorder()
+	h.Handle(w, r)
+	return w
+}
+
+func TestAdClickRefusesUnsignedTarget(t *testing.T) {
+	for _, enforce := range []bool{false, true} {
+		h, _ := newTestAdClickHandler(t, enforce)
+		w := adClick(h, url.Values{"u": {"https://evil.example/phish"}, "pid": {"100"}})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("enforce=%v: unsigned u= answered %d, want 403", enforce, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != "" {
+			t.Errorf("enforce=%v: unsigned u= redirected to %s", enforce, loc)
+		}
+	}
+}
+
+func TestAdClickRefusesForgedTarget(t *testing.T) {
+	h, signer := newTestAdClickHandler(t, false)
+	q := url.Values{"u": {"https://advertiser.example/landing"}, "pid": {"100"}}
+	signer.Sign(q)
+	q.Set("u", "https://evil.example/phish")
+
+	if w := adClick(h, q); w.Code != http.StatusForbidden || w.Header().Get("Location") != "" {
+		t.Errorf("forged u= answered %d to %q, want 403", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestAdClickRedirectsSignedTarget(t *testing.T) {
+	h, signer := newTestAdClickHandler(t, false)
+	q := url.Values{"u": {"https://advertiser.example/landing"}, "pid": {"100"}}
+	signer.Sign(q)
+
+	w := adClick(h, q)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://advertiser.example/landing" {
+		t.Errorf("signed link answered %d to %q, want a redirect to the target", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,483 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"adserving/config"
+	"adserving/services"
+	"adserving/utils"
+)
+
+var (
+	templateSizeRe = regexp.MustCompile(`^\d+x\d+$`)
+	countryCodeRe  = regexp.MustCompile(`^([A-Z]{2}|\*)$`)
+	deviceClasses  = map[string]bool{"bot": true, "mobile": true, "tablet": true, "desktop": true}
+
+	// reservedPartnerParams are set by KeywordService from the request and
+	// would silently win over a partner profile value.
+	reservedPartnerParams = map[string]bool{
+		"maxno": true, "actno": true, "json": true, "type": true, "cc": true, "lid": true,
+		"tsize": true, "d": true, "dtld": true, "ptitle": true, "rurl": true, "kwrf": true,
+	}
+)
+
+// ruleRequest is the body accepted by the create and update endpoints.
+type ruleRequest struct {
+	RuleName    string                `json:"rule_name"`
+	PublisherID int                   `json:"publisher_id"`
+	UserAgent   string                `json:"user_agent"`
+	CountryCode string                `json:"country_code"`
+	Priority    int                   `json:"priority"`
+	Enabled     *bool                 `json:"enabled"`
+	Conditions  config.RuleConditions `json:"conditions"`
+	Action      *config.RuleAction    `json:"action"`
+}
+
+// AdminHandler serves the rules admin API under /admin/rules. Every request
+// must carry "Authorization: Bearer <ADMIN_TOKEN>"; with no token configured
+// the API is disabled.
+type AdminHandler struct {
+	token string
+}
+
+func NewAdminHandler(token string) *AdminHandler {
+	return &AdminHandler{token: token}
+}
+
+func (h *AdminHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	// /admin/rules, /admin/rules/explain, /admin/rules/{id},
+	// /admin/rules/{id}/{enable|disable|history|rollback}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/rules"), "/"), "/")
+	if parts[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			h.listRules(w, r)
+		case http.MethodPost:
+			h.createRule(w, r)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	if parts[0] == "explain" && len(parts) == 1 && r.Method == http.MethodGet {
+		h.explain(w, r)
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || id <= 0 {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if len(parts) == 2 {
+		switch {
+		case r.Method == http.MethodPost && (parts[1] == "enable" || parts[1] == "disable"):
+			h.setEnabled(w, r, id, parts[1] == "enable")
+		case r.Method == http.MethodGet && parts[1] == "history":
+			h.ruleHistory(w, id)
+		case r.Method == http.MethodPost && parts[1] == "rollback":
+			h.rollbackRule(w, r, id)
+		default:
+			writeJSONError(w, http.StatusNotFound, "not found")
+		}
+		return
+	}
+	if len(parts) > 1 {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getRule(w, id)
+	case http.MethodPut:
+		h.updateRule(w, r, id)
+	case http.MethodDelete:
+		h.deleteRule(w, r, id)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *AdminHandler) authorized(r *http.Request) bool {
+	if h.token == "" {
+		return false
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(h.token)) == 1
+}
+
+func (h *AdminHandler) listRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := config.ListRules(utils.AtoiOrZero(r.URL.Query().Get("publisher_id")))
+	if err != nil {
+		writeRuleError(w, err)
+		return
+	}
+	if rules == nil {
+		rules = []config.Rule{}
+	}
+	writeJSON(w, http.StatusOK, rules)
+}
+
+func (h *AdminHandler) getRule(w http.ResponseWriter, id int) {
+	rule, err := config.GetRule(id)
+	if err != nil {
+		writeRuleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func (h *AdminHandler) createRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := decodeRule(w, r)
+	if !ok {
+		return
+	}
+	rule, err := config.CreateRule(rule, adminActor(r))
+	if err != nil {
+		writeRuleError(w, err)
+		return
+	}
+	log.Printf("admin: created rule %d (%s) for publisher %d", rule.ID, rule.RuleName, rule.PublisherID)
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+func (h *AdminHandler) updateRule(w http.ResponseWriter, r *http.Request, id int) {
+	rule, ok := decodeRule(w, r)
+	if !ok {
+		return
+	}
+	rule.ID = id
+	rule, err := config.UpdateRule(rule, adminActor(r))
+	if err != nil {
+		writeRuleError(w, err)
+		return
+	}
+	log.Printf("admin: updated rule %d (%s)", rule.ID, rule.RuleName)
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func (h *AdminHandler) deleteRule(w http.ResponseWriter, r *http.Request, id int) {
+	if err := config.DeleteRule(id, adminActor(r)); err != nil {
+		writeRuleError(w, err)
+		return
+	}
+	log.Printf("admin: deleted rule %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AdminHandler) setEnabled(w http.ResponseWriter, r *http.Request, id int, enabled bool) {
+	rule, err := config.SetRuleEnabled(id, enabled, adminActor(r))
+	if err != nil {
+		writeRuleError(w, err)
+		return
+	}
+	log.Printf("admin: set rule %d enabled=%v", id, enabled)
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func (h *AdminHandler) ruleHistory(w http.ResponseWriter, id int) {
+	entries, err := config.RuleHistory(id)
+	if err != nil {
+		writeRuleError(w, err)
+		return
+	}
+	if entries == nil {
+		entries = []config.RuleHistoryEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (h *AdminHandler) rollbackRule(w http.ResponseWriter, r *http.Request, id int) {
+	var req struct {
+		Version int `json:"version"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil || req.Version <= 0 {
+		writeJSONError(w, http.StatusBadRequest, `body must be {"version": <positive int>}`)
+		return
+	}
+
+	rule, err := config.RollbackRule(id, req.Version, adminActor(r))
+	if err != nil {
+		writeRuleError(w, err)
+		return
+	}
+	log.Printf("admin: rolled back rule %d to version %d", id, req.Version)
+	writeJSON(w, http.StatusOK, rule)
+}
+
+// adminActor names who made a change, as given in X-Admin-User. The shared
+// bearer token cannot identify people, so this is self-declared.
+func adminActor(r *http.Request) string {
+	if user := strings.TrimSpace(r.Header.Get("X-Admin-User")); user != "" {
+		if len(user) > 255 {
+			user = user[:255]
+		}
+		return user
+	}
+	return "admin"
+}
+
+// decodeRule parses and validates a rule body, writing a 400 response and
+// returning false when it is not acceptable.
+func decodeRule(w http.ResponseWriter, r *http.Request) (config.Rule, bool) {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+
+	var req ruleRequest
+	if err := dec.Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return config.Rule{}, false
+	}
+	if dec.More() {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON: trailing data")
+		return config.Rule{}, false
+	}
+
+	if problems := validateRuleRequest(req); len(problems) > 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "validation failed", "details": problems})
+		return config.Rule{}, false
+	}
+
+	rule := config.Rule{
+		RuleName:    strings.TrimSpace(req.RuleName),
+		Action:      *req.Action,
+		PublisherID: req.PublisherID,
+		UserAgent:   req.UserAgent,
+		CountryCode: strings.ToUpper(req.CountryCode),
+		Priority:    req.Priority,
+		Conditions:  req.Conditions,
+		Enabled:     req.Enabled == nil || *req.Enabled,
+	}
+	return rule, true
+}
+
+func validateRuleRequest(req ruleRequest) []string {
+	var problems []string
+	if strings.TrimSpace(req.RuleName) == "" {
+		problems = append(problems, "rule_name is required")
+	}
+	if req.PublisherID <= 0 {
+		problems = append(problems, "publisher_id must be positive")
+	}
+	if req.CountryCode != "" && !countryCodeRe.MatchString(strings.ToUpper(req.CountryCode)) {
+		problems = append(problems, "country_code must be a two-letter code or *")
+	}
+
+	c := req.Conditions
+	for _, cc := range c.Countries {
+		if !countryCodeRe.MatchString(strings.ToUpper(cc)) {
+			problems = append(problems, fmt.Sprintf("conditions.countries: invalid code %q", cc))
+		}
+	}
+	if c.DeviceClass != "" && !deviceClasses[strings.ToLower(c.DeviceClass)] {
+		problems = append(problems, "conditions.device_class must be one of bot, mobile, tablet, desktop")
+	}
+	if tw := c.TimeWindow; tw != nil {
+		if _, err := time.Parse("15:04", tw.From); err != nil {
+			problems = append(problems, "conditions.time_window.from must be HH:MM")
+		}
+		if _, err := time.Parse("15:04", tw.To); err != nil {
+			problems = append(problems, "conditions.time_window.to must be HH:MM")
+		}
+	}
+
+	problems = append(problems, validateSchedule(c)...)
+
+	if req.Action == nil {
+		return append(problems, "action is required")
+	}
+	a := *req.Action
+	// Bots are never shown ads, so their SERP template may have no ad slots
+	countAdSlots := utils.CountAdSlots
+	if ruleTargetsBots(req) {
+		countAdSlots = nil
+	}
+	problems = append(problems, validateTemplate("action.serp_template_id", a.SerpTemplateID, countAdSlots)...)
+	problems = append(problems, validateTemplate("action.keyword_template_id", a.KeywordTemplateID, utils.CountKeywordSlots)...)
+	if a.LayoutID < 0 {
+		problems = append(problems, "action.layout_id must not be negative")
+	}
+	if a.TemplateSize != "" && !templateSizeRe.MatchString(a.TemplateSize) {
+		problems = append(problems, "action.template_size must look like 300x250")
+	}
+	if a.Experiment != nil {
+		problems = append(problems, validateExperiment(a.Experiment, countAdSlots)...)
+	}
+	for k := range a.PartnerParams {
+		if k == "" || reservedPartnerParams[k] {
+			problems = append(problems, fmt.Sprintf("action.partner_params: %q cannot be overridden", k))
+		}
+	}
+	if a.KeywordProvider != "" && !services.KnownKeywordProvider(a.KeywordProvider) {
+		problems = append(problems, "action.keyword_provider must be one of api, static, curated")
+	}
+	seenProviders := make(map[string]bool)
+	for _, p := range a.AdProviders {
+		if !services.KnownAdProvider(p.Name) {
+			problems = append(problems, fmt.Sprintf("action.ad_providers: unknown provider %q, must be one of yahoo, json", p.Name))
+		} else if seenProviders[p.Name] {
+			problems = append(problems, fmt.Sprintf("action.ad_providers: %q listed twice", p.Name))
+		}
+		seenProviders[p.Name] = true
+		if p.Weight <= 0 {
+			problems = append(problems, fmt.Sprintf("action.ad_providers: weight of %q must be positive", p.Name))
+		}
+	}
+	if a.ThrottlePercent < 0 || a.ThrottlePercent > 100 {
+		problems = append(problems, "action.throttle_percent must be between 0 and 100")
+	}
+	if a.QPSCap < 0 {
+		problems = append(problems, "action.qps_cap must not be negative")
+	}
+	switch a.ThrottleFallback {
+	case "", config.ThrottleFallbackDummy, config.ThrottleFallbackEmpty, config.ThrottleFallbackHouse:
+	default:
+		problems = append(problems, "action.throttle_fallback must be one of dummy, empty, house")
+	}
+	if a.InvalidClickScore < 0 || a.InvalidClickScore > 100 {
+		problems = append(problems, "action.invalid_click_score must be between 0 and 100")
+	}
+	switch a.InvalidClickAction {
+	case "", config.InvalidClickRedirect, config.InvalidClickReject:
+	default:
+		problems = append(problems, "action.invalid_click_action must be one of redirect, reject")
+	}
+	return problems
+}
+
+func validateSchedule(c config.RuleConditions) []string {
+	var problems []string
+	var start, end time.Time
+	var err error
+	if c.StartsAt != "" {
+		if start, err = config.ParseScheduleTime(c.StartsAt, time.UTC); err != nil {
+			problems = append(problems, "conditions.starts_at must be RFC 3339 or 2006-01-02T15:04")
+		}
+	}
+	if c.EndsAt != "" {
+		if end, err = config.ParseScheduleTime(c.EndsAt, time.UTC); err != nil {
+			problems = append(problems, "conditions.ends_at must be RFC 3339 or 2006-01-02T15:04")
+		}
+	}
+	if !start.IsZero() && !end.IsZero() && !start.Before(end) {
+		problems = append(problems, "conditions.starts_at must be before conditions.ends_at")
+	}
+
+	if sch := c.Schedule; sch != nil {
+		for _, d := range sch.Days {
+			if !config.ValidWeekday(d) {
+				problems = append(problems, fmt.Sprintf("conditions.schedule.days: invalid day %q", d))
+			}
+		}
+		for _, h := range sch.Hours {
+			if h < 0 || h > 23 {
+				problems = append(problems, fmt.Sprintf("conditions.schedule.hours: invalid hour %d", h))
+			}
+		}
+	}
+	return problems
+}
+
+// validateExperiment checks an experiment's variants, counting SERP
+// template ad slots with countAdSlots as for the rule's own action.
+func validateExperiment(exp *config.Experiment, countAdSlots func(string) int) []string {
+	var problems []string
+	if exp.ID == "" || len(exp.ID) > 64 {
+		problems = append(problems, "action.experiment.id is required and must be at most 64 characters")
+	}
+	if len(exp.Variants) < 2 {
+		problems = append(problems, "action.experiment needs at least two variants")
+	}
+
+	seen := map[string]bool{}
+	for i, v := range exp.Variants {
+		field := fmt.Sprintf("action.experiment.variants[%d]", i)
+		if v.ID == "" || len(v.ID) > 64 {
+			problems = append(problems, field+".id is required and must be at most 64 characters")
+		} else if seen[v.ID] {
+			problems = append(problems, fmt.Sprintf("%s.id %q is duplicated", field, v.ID))
+		}
+		seen[v.ID] = true
+		if v.Weight <= 0 {
+			problems = append(problems, field+".weight must be positive")
+		}
+		if v.SerpTemplateID != "" {
+			problems = append(problems, validateTemplate(field+".serp_template_id", v.SerpTemplateID, countAdSlots)...)
+		}
+		if v.KeywordTemplateID != "" {
+			problems = append(problems, validateTemplate(field+".keyword_template_id", v.KeywordTemplateID, utils.CountKeywordSlots)...)
+		}
+	}
+	return problems
+}
+
+// ruleTargetsBots reports whether the rule only matches bot traffic.
+func ruleTargetsBots(req ruleRequest) bool {
+	return utils.IsBotUA(req.UserAgent) || utils.IsBotUA(req.Conditions.UserAgent) ||
+		strings.EqualFold(req.Conditions.DeviceClass, "bot")
+}
+
+// validateTemplate checks that a template id names a file directly under
+// storage/html that has at least one slot as counted by countSlots, if not
+// nil.
+func validateTemplate(field, id string, countSlots func(string) int) []string {
+	if id == "" {
+		return []string{field + " is required"}
+	}
+	if filepath.Base(id) != id || !strings.HasSuffix(id, ".html") {
+		return []string{fmt.Sprintf("%s: %q is not a template file name", field, id)}
+	}
+	if !utils.FileExists(templateDir + id) {
+		return []string{fmt.Sprintf("%s: template %q does not exist", field, id)}
+	}
+	if countSlots != nil && countSlots(templateDir+id) == 0 {
+		return []string{fmt.Sprintf("%s: template %q has no slots", field, id)}
+	}
+	return nil
+}
+
+func writeRuleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, config.ErrRuleNotFound), errors.Is(err, config.ErrVersionNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, config.ErrDuplicateRule), errors.Is(err, config.ErrVersionDeleted), errors.Is(err, config.ErrVersionInvalid):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, config.ErrNoDatabase):
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		log.Printf("admin rules error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("admin response encode error: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
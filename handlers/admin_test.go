@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"adserving/config"
+)
+
+// inRepoRoot runs the test from the repository root, where the templates
+// validateRuleRequest checks live.
+func inRepoRoot(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func botRuleRequest(variantSerp string) ruleRequest {
+	return ruleRequest{
+		RuleName:    "googlebot_experiment",
+		PublisherID: 100,
+		UserAgent:   "Googlebot",
+		Action: &config.RuleAction{
+			SerpTemplateID:    "SerptemplateBot.html",
+			KeywordTemplateID: "KeywordTemplateBot.html",
+			Experiment: &config.Experiment{ID: "bot_layout", Variants: []config.ExperimentVariant{
+				{ID: "a", Weight: 50},
+				{ID: "b", Weight: 50, SerpTemplateID: variantSerp},
+			}},
+		},
+	}
+}
+
+func TestValidateBotRuleVariantWithoutAdSlots(t *testing.T) {
+	inRepoRoot(t)
+
+	if problems := validateRuleRequest(botRuleRequest("SerptemplateBot.html")); len(problems) != 0 {
+		t.Errorf("bot rule with a bot template variant: %v", problems)
+	}
+
+	req := botRuleRequest("SerptemplateBot.html")
+	req.UserAgent = "Android"
+	problems := validateRuleRequest(req)
+	if len(problems) == 0 || !strings.Contains(strings.Join(problems, "\n"), "variants[1].serp_template_id") {
+		t.Errorf("non-bot rule with a slotless variant template: %v, want a variant slot problem", problems)
+	}
+}
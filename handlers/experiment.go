@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"adserving/config"
+	"adserving/utils"
+)
+
+const visitorCookie = "adx_vid"
+
+// applyExperiment resolves the experiment variant for a request and returns
+// the action with that variant applied, plus the experiment and variant ids
+// to propagate. A variant already carried in the URL (exp/var params) is
+// kept when it still exists so a visitor stays in one arm across the
+// keyword -> SERP -> click funnel.
+func applyExperiment(w http.ResponseWriter, r *http.Request, action config.RuleAction) (config.RuleAction, string, string) {
+	q := r.URL.Query()
+	return resolveExperiment(action, q.Get("exp"), q.Get("var"), func() string { return visitorKey(w, r) })
+}
+
+// resolveExperiment is applyExperiment for a carried exp/var pair and a
+// visitor key, which is only asked for when a variant must be assigned.
+func resolveExperiment(action config.RuleAction, carriedExp, carriedVar string, visitor func() string) (config.RuleAction, string, string) {
+	exp := action.Experiment
+	if exp == nil || exp.ID == "" {
+		return action, "", ""
+	}
+
+	if carriedExp == exp.ID {
+		if v, ok := exp.Variant(carriedVar); ok {
+			return action.WithVariant(v), exp.ID, v.ID
+		}
+	}
+
+	v, ok := exp.AssignVariant(visitor())
+	if !ok {
+		return action, "", ""
+	}
+	return action.WithVariant(v), exp.ID, v.ID
+}
+
+// visitorKey returns a stable per-visitor id from the visitor cookie. When
+// the cookie is missing it is derived from client IP and user agent, so the
+// assignment is the same whether or not the browser keeps the cookie.
+func visitorKey(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(visitorCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	sum := sha256.Sum256([]byte(utils.GetClientIP(r) + "|" + r.UserAgent()))
+	key := hex.EncodeToString(sum[:8])
+
+	secure := utils.GetScheme(r) == "https"
+	sameSite := http.SameSiteLaxMode
+	if secure {
+		sameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorCookie,
+		Value:    key,
+		Path:     "/",
+		Expires:  time.Now().Add(90 * 24 * time.Hour),
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: sameSite,
+	})
+	return key
+}
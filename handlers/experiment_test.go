@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"adserving/config"
+)
+
+func TestExplainMatchesServedVariant(t *testing.T) {
+	action := config.RuleAction{
+		SerpTemplateID:    "SerpTemplate1.html",
+		KeywordTemplateID: "KeywordTemplate1.html",
+		Experiment: &config.Experiment{ID: "e1", Variants: []config.ExperimentVariant{
+			{ID: "a", Weight: 50},
+			{ID: "b", Weight: 50, SerpTemplateID: "SerpTemplate2.html"},
+		}},
+	}
+
+	for _, vid := range []string{"v1", "v2", "v3", "v4", "v5", "v6"} {
+		r := httptest.NewRequest("GET", "/keyword_render", nil)
+		r.AddCookie(&http.Cookie{Name: visitorCookie, Value: vid})
+		served, _, servedVar := applyExperiment(httptest.NewRecorder(), r, action)
+
+		explained, expID, expVar := resolveExperiment(action, "", "", func() string { return vid })
+		if expID != "e1" || expVar != servedVar || explained.SerpTemplateID != served.SerpTemplateID {
+			t.Errorf("visitor %s: explained %s/%s (%s), served %s (%s)",
+				vid, expID, expVar, explained.SerpTemplateID, servedVar, served.SerpTemplateID)
+		}
+	}
+}
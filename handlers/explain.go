@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"adserving/config"
+	"adserving/models"
+	"adserving/services"
+	"adserving/utils"
+)
+
+// ExplainInput describes a hypothetical request to resolve a rule for.
+type ExplainInput struct {
+	PublisherID  int
+	UserAgent    string
+	CountryCode  string
+	Domain       string
+	Slot         string
+	Referrer     string
+	LayoutID     string
+	TemplateSize string
+	// At is the time schedules are evaluated at; zero means now.
+	At time.Time
+	// VisitorID is the visitor key experiments assign variants by (the
+	// adx_vid cookie); without it no variant is assigned.
+	VisitorID string
+}
+
+// ResolvedAction is what RenderHandler and SerpHandler would actually do
+// with the matched rule, after template fallbacks and layout overrides.
+type ResolvedAction struct {
+	Blocked                 bool   `json:"blocked"`
+	KeywordTemplate         string `json:"keyword_template"`
+	KeywordTemplateFallback bool   `json:"keyword_template_fallback"`
+	MaxKeywords             int    `json:"max_keywords"`
+	SerpTemplate            string `json:"serp_template"`
+	SerpTemplateFallback    bool   `json:"serp_template_fallback"`
+	MaxAds                  int    `json:"max_ads"`
+	LayoutID                string `json:"layout_id"`
+	TemplateSize            string `json:"template_size"`
+	LinkTarget              string `json:"link_target"`
+	AdsSuppressedForBot     bool   `json:"ads_suppressed_for_bot"`
+
+	PartnerParams config.PartnerParams      `json:"partner_params"`
+	AdProviders   []config.AdProviderWeight `json:"ad_providers"`
+
+	// Throttle settings of the rule; ThrottleFallback is what shed requests
+	// get, defaulted like checkThrottle does.
+	ThrottlePercent  int     `json:"throttle_percent"`
+	QPSCap           float64 `json:"qps_cap"`
+	ThrottleFallback string  `json:"throttle_fallback"`
+
+	// The experiment arm the visitor would be served; the variant's
+	// overrides are already applied to the templates above.
+	ExperimentID string                    `json:"experiment_id,omitempty"`
+	VariantID    string                    `json:"variant_id,omitempty"`
+	Variant      *config.ExperimentVariant `json:"variant,omitempty"`
+
+	InvalidClickScore  int    `json:"invalid_click_score"`
+	InvalidClickAction string `json:"invalid_click_action"`
+}
+
+type Explanation struct {
+	DeviceClass string                 `json:"device_class"`
+	Rule        config.RuleExplanation `json:"rule"`
+	Resolved    ResolvedAction         `json:"resolved"`
+}
+
+// Explain resolves the rule for in and the action the ad handlers would take.
+func Explain(in ExplainInput) Explanation {
+	if in.CountryCode == "" {
+		in.CountryCode = "US"
+	}
+	if in.At.IsZero() {
+		in.At = time.Now()
+	}
+
+	ex := Explanation{
+		DeviceClass: utils.DeviceClass(in.UserAgent),
+		Rule: config.ExplainRule(config.RuleContext{
+			PublisherID: in.PublisherID,
+			UserAgent:   in.UserAgent,
+			CountryCode: in.CountryCode,
+			Domain:      in.Domain,
+			Slot:        in.Slot,
+			Referrer:    in.Referrer,
+			Now:         in.At,
+		}),
+	}
+
+	action := ex.Rule.Matched.Action
+	var experimentID, variantID string
+	if in.VisitorID != "" {
+		action, experimentID, variantID = resolveExperiment(action, "", "", func() string { return in.VisitorID })
+	} else if action.Experiment != nil {
+		experimentID = action.Experiment.ID
+	}
+	params := models.RenderParams{LayoutID: in.LayoutID, TemplateSize: in.TemplateSize}
+	applyRuleLayout(&params, action)
+
+	kwPath, maxKeywords := resolveKeywordTemplate(action)
+	serpPath, maxAds := resolveSerpTemplate(action)
+
+	linkTarget := "_parent"
+	if action.OpenInNewTab {
+		linkTarget = "_blank"
+	}
+
+	ex.Resolved = ResolvedAction{
+		Blocked:                 action.Block,
+		KeywordTemplate:         strings.TrimPrefix(kwPath, templateDir),
+		KeywordTemplateFallback: kwPath == dummyKeywordTemplate,
+		MaxKeywords:             maxKeywords,
+		SerpTemplate:            strings.TrimPrefix(serpPath, templateDir),
+		SerpTemplateFallback:    serpPath == dummySerpTemplate,
+		MaxAds:                  maxAds,
+		LayoutID:                params.LayoutID,
+		TemplateSize:            params.TemplateSize,
+		LinkTarget:              linkTarget,
+		AdsSuppressedForBot:     utils.IsBotUA(in.UserAgent),
+		PartnerParams:           config.PartnerParamsFor(in.PublisherID, action),
+		AdProviders:             action.AdProviders,
+	}
+	ex.Resolved.ThrottlePercent, ex.Resolved.QPSCap = action.ThrottlePercent, action.QPSCap
+	ex.Resolved.ThrottleFallback = action.ThrottleFallback
+	if ex.Resolved.ThrottleFallback == "" {
+		ex.Resolved.ThrottleFallback = config.ThrottleFallbackDummy
+	}
+	ex.Resolved.ExperimentID, ex.Resolved.VariantID = experimentID, variantID
+	if variantID != "" {
+		if v, ok := action.Experiment.Variant(variantID); ok {
+			ex.Resolved.Variant = &v
+		}
+	}
+	ex.Resolved.InvalidClickScore, ex.Resolved.InvalidClickAction = action.InvalidClickPolicy()
+	if len(ex.Resolved.AdProviders) == 0 {
+		ex.Resolved.AdProviders = []config.AdProviderWeight{{Name: services.AdProviderYahoo, Weight: 1}}
+	}
+	return ex
+}
+
+// explain serves GET /admin/rules/explain?pid=&ua=&cc=&d=&slot=&ref=&lid=&tsize=&vid=&at=
+func (h *AdminHandler) explain(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	pid, err := strconv.Atoi(q.Get("pid"))
+	if err != nil || pid <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "pid must be a positive integer")
+		return
+	}
+	var at time.Time
+	if s := q.Get("at"); s != "" {
+		if at, err = time.Parse(time.RFC3339, s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "at must be an RFC 3339 time")
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, Explain(ExplainInput{
+		PublisherID:  pid,
+		UserAgent:    q.Get("ua"),
+		CountryCode:  q.Get("cc"),
+		Domain:       q.Get("d"),
+		Slot:         q.Get("slot"),
+		Referrer:     q.Get("ref"),
+		LayoutID:     q.Get("lid"),
+		TemplateSize: q.Get("tsize"),
+		VisitorID:    q.Get("vid"),
+		At:           at,
+	}))
+}
@@ -1,24 +1,46 @@
 package handlers
 
 import (
-	"log"
 	"net/http"
 	"strings"
 
 	"adserving/db"
+	"adserving/services"
 	"adserving/utils"
 )
 
-func HandleKeywordImpression(w http.ResponseWriter, r *http.Request) {
+// 1x1 transparent GIF
+var transparentGIF = []byte{0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b}
+
+type ImpressionHandler struct {
+	signer *services.URLSigner
+}
+
+func NewImpressionHandler(signer *services.URLSigner) *ImpressionHandler {
+	return &ImpressionHandler{signer: signer}
+}
+
+func (h *ImpressionHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "image/gif")
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 
 	q := r.URL.Query()
+
+	// Refused links still get the pixel, they are just not counted
+	verdict, ok := h.signer.Check("keyword_impression", q)
+	if !ok {
+		w.Write(transparentGIF)
+		return
+	}
+
 	publisherID := utils.AtoiOrZero(q.Get("pid"))
 	slot := q.Get("slot")
 	countryCode := q.Get("cc")
 	keywords := q.Get("keywords")
 	keywordIDs := q.Get("keyword_ids")
+	experimentID := q.Get("exp")
+	variantID := q.Get("var")
+	renderID := utils.RequestIDParam(q.Get("rid"))
 
 	clientIP := utils.GetClientIP(r)
 	userAgent := r.UserAgent()
@@ -32,23 +54,22 @@ func HandleKeywordImpression(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		var keywordID any = nil
+		var keywordID int
 		if i < len(keywordIDList) {
-			if id := utils.AtoiOrZero(strings.TrimSpace(keywordIDList[i])); id != 0 {
-				keywordID = id
-			}
+			keywordID = utils.AtoiOrZero(strings.TrimSpace(keywordIDList[i]))
 		}
 
-		_, err := db.GetDB().Exec(
-			`INSERT INTO keyword_impression (publisher_id, keyword_id, keyword_title, slot, client_ip, user_agent, country_code) VALUES (?, ?, ?, ?, ?, ?, ?)`,
-			publisherID, keywordID, kw, slot, clientIP, userAgent, countryCode,
-		)
-		if err != nil {
-			log.Printf("keyword_impression insert error: %v", err)
-		}
+		db.RecordEvent(db.KeywordImpression{
+			RenderID:     renderID,
+			PublisherID:  publisherID,
+			KeywordID:    keywordID,
+			KeywordTitle: kw,
+			Slot:         slot,
+			Visitor:      db.Visitor{ClientIP: clientIP, UserAgent: userAgent, CountryCode: countryCode},
+			Variant:      db.Variant{ExperimentID: experimentID, VariantID: variantID},
+			SigVerdict:   verdict,
+		})
 	}
 
-	// 1x1 transparent GIF
-	gif := []byte{0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b}
-	w.Write(gif)
+	w.Write(transparentGIF)
 }
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"adserving/config"
 	"adserving/models"
@@ -17,14 +18,19 @@ import (
 	"adserving/utils"
 )
 
-const dummyKeywordTemplate = "storage/html/KeywordTemplateDummy.html"
+const (
+	templateDir          = "storage/html/"
+	dummyKeywordTemplate = templateDir + "KeywordTemplateDummy.html"
+)
 
 type RenderHandler struct {
-	keywordService *services.KeywordService
+	keywordProviders *services.KeywordProviders
+	throttler        *services.Throttler
+	signer           *services.URLSigner
 }
 
-func NewRenderHandler(keywordService *services.KeywordService) *RenderHandler {
-	return &RenderHandler{keywordService: keywordService}
+func NewRenderHandler(keywordProviders *services.KeywordProviders, throttler *services.Throttler, signer *services.URLSigner) *RenderHandler {
+	return &RenderHandler{keywordProviders: keywordProviders, throttler: throttler, signer: signer}
 }
 
 func (h *RenderHandler) Handle(w http.ResponseWriter, r *http.Request) {
@@ -34,7 +40,7 @@ func (h *RenderHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	params := models.RenderParams{
 		Slot:         q.Get("slot"),
-		CountryCode:  q.Get("cc"),
+		CountryCode:  utils.GetCountryCode(r),
 		TemplateSize: q.Get("tsize"),
 		PublisherID:  q.Get("pid"),
 		Domain:       q.Get("d"),
@@ -50,7 +56,15 @@ func (h *RenderHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	publisherID := utils.AtoiOrZero(params.PublisherID)
-	rule := config.GetRuleByPublisherIDAndUserAgent(publisherID, userAgent)
+	rule := config.GetRuleForRequest(config.RuleContext{
+		PublisherID: publisherID,
+		UserAgent:   userAgent,
+		CountryCode: params.CountryCode,
+		Domain:      params.Domain,
+		Slot:        params.Slot,
+		Referrer:    params.KeywordRef,
+		Now:         time.Now(),
+	})
 
 	if rule.Action.Block {
 		w.WriteHeader(http.StatusForbidden)
@@ -58,19 +72,34 @@ func (h *RenderHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Try to get template, fallback to dummy
-	keywordTemplatePath := "storage/html/" + rule.Action.KeywordTemplateID
-	maxKeywords := utils.CountKeywordSlots(keywordTemplatePath)
-	if maxKeywords == 0 {
-		keywordTemplatePath = dummyKeywordTemplate
-		maxKeywords = 3
+	throttled := checkThrottle(h.throttler, r, rule, publisherID, params.CountryCode, "keyword_render")
+	if throttled == config.ThrottleFallbackEmpty {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	action, experimentID, variantID := applyExperiment(w, r, rule.Action)
+
+	applyRuleLayout(&params, action)
+
+	keywordTemplatePath, maxKeywords := resolveKeywordTemplate(action)
+	if throttled == config.ThrottleFallbackDummy {
+		keywordTemplatePath, maxKeywords = dummyKeywordTemplate, 3
 	}
 
 	// Set maxno from template slot count
 	params.MaxNumber = maxKeywords
-
-	// FetchKeywords returns defaults on error
-	keywords, keywordIDs, _ := h.keywordService.FetchKeywords(params)
+	params.PartnerParams = config.PartnerParamsFor(publisherID, action)
+
+	var keywords []string
+	var keywordIDs []int64
+	if throttled != "" {
+		// Throttled traffic never reaches the keyword API
+		keywords, keywordIDs = services.DefaultKeywords, services.DefaultKeywordIDs
+	} else {
+		// FetchKeywords returns defaults on error
+		keywords, keywordIDs, _ = h.keywordProviders.Get(action.KeywordProvider).FetchKeywords(r.Context(), params)
+	}
 
 	if len(keywords) > maxKeywords {
 		keywords = keywords[:maxKeywords]
@@ -81,8 +110,11 @@ func (h *RenderHandler) Handle(w http.ResponseWriter, r *http.Request) {
 
 	baseURL := utils.GetScheme(r) + "://" + r.Host
 
+	// renderID ties this render's impression to the keyword clicks it leads to
+	renderID := utils.NewRequestID()
+
 	linkTarget := "_parent"
-	if rule.Action.OpenInNewTab {
+	if action.OpenInNewTab {
 		linkTarget = "_blank"
 	}
 
@@ -94,10 +126,18 @@ func (h *RenderHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		qs.Set("slot", params.Slot)
 		qs.Set("cc", params.CountryCode)
 		qs.Set("pid", params.PublisherID)
+		qs.Set("d", params.Domain)
+		qs.Set("rid", renderID)
+		if variantID != "" {
+			qs.Set("exp", experimentID)
+			qs.Set("var", variantID)
+		}
 		if i < len(keywordIDs) && keywordIDs[i] != 0 {
 			qs.Set("kid", strconv.FormatInt(keywordIDs[i], 10))
 		}
 
+		h.signer.Sign(qs)
+
 		idx := strconv.Itoa(i + 1)
 		dataMap["KwTitle"+idx] = html.EscapeString(kw)
 		dataMap["KwHref"+idx] = baseURL + "/serp?" + qs.Encode()
@@ -139,8 +179,20 @@ func (h *RenderHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	impParams.Set("cc", params.CountryCode)
 	impParams.Set("keywords", strings.Join(keywords, ","))
 	impParams.Set("keyword_ids", strings.Join(kidStrs, ","))
+	impParams.Set("rid", renderID)
+	if variantID != "" {
+		impParams.Set("exp", experimentID)
+		impParams.Set("var", variantID)
+	}
+	h.signer.Sign(impParams)
 	impURL := baseURL + "/keyword_impression?" + impParams.Encode()
 
+	// Throttled renders are counted in throttle_event, not as impressions
+	impScript := fmt.Sprintf(`window.parent.postMessage({type:'impression',url:'%s'},'*');`, impURL)
+	if throttled != "" {
+		impScript = ""
+	}
+
 	fmt.Fprintf(w, `<!DOCTYPE html>
 <html>
 <head>
@@ -154,9 +206,32 @@ a:hover{text-decoration:underline}
 </head>
 <body>
 %s
-<script>if(window.parent!==window){window.parent.postMessage({type:'impression',url:'%s'},'*');}</script>
+<script>if(window.parent!==window){window.parent.postMessage({type:'resize',width:%d,height:%d},'*');%s}</script>
 </body>
-</html>`, widthPx, heightPx, buf.String(), impURL)
+</html>`, widthPx, heightPx, buf.String(), widthPx, heightPx, impScript)
+}
+
+// resolveKeywordTemplate returns the keyword template to render and how many
+// keywords it holds, falling back to the dummy template when the rule's
+// template is missing or has no keyword slots.
+func resolveKeywordTemplate(action config.RuleAction) (string, int) {
+	path := templateDir + action.KeywordTemplateID
+	if n := utils.CountKeywordSlots(path); n > 0 {
+		return path, n
+	}
+	return dummyKeywordTemplate, 3
+}
+
+// applyRuleLayout sets the layout id and template size from the rule. The
+// lid/tsize request params are used only when the rule leaves a value unset
+// or explicitly allows overriding it.
+func applyRuleLayout(params *models.RenderParams, action config.RuleAction) {
+	if action.LayoutID > 0 && (params.LayoutID == "" || !action.AllowParamOverride) {
+		params.LayoutID = strconv.Itoa(action.LayoutID)
+	}
+	if action.TemplateSize != "" && (params.TemplateSize == "" || !action.AllowParamOverride) {
+		params.TemplateSize = action.TemplateSize
+	}
 }
 
 func renderErrorHTML(w http.ResponseWriter, msg string) {
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
 	"adserving/config"
 	"adserving/db"
@@ -16,14 +17,18 @@ import (
 	"adserving/utils"
 )
 
-const dummySerpTemplate = "storage/html/SerpTemplateDummy.html"
+const dummySerpTemplate = templateDir + "SerpTemplateDummy.html"
 
 type SerpHandler struct {
-	yahooService *services.YahooService
+	auction   *services.AdAuction
+	beacons   *services.BeaconService
+	throttler *services.Throttler
+	signer    *services.URLSigner
+	quality   *services.ClickQuality
 }
 
-func NewSerpHandler(yahooService *services.YahooService) *SerpHandler {
-	return &SerpHandler{yahooService: yahooService}
+func NewSerpHandler(auction *services.AdAuction, beacons *services.BeaconService, throttler *services.Throttler, signer *services.URLSigner, quality *services.ClickQuality) *SerpHandler {
+	return &SerpHandler{auction: auction, beacons: beacons, throttler: throttler, signer: signer, quality: quality}
 }
 
 func (h *SerpHandler) Handle(w http.ResponseWriter, r *http.Request) {
@@ -35,16 +40,34 @@ func (h *SerpHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	params := models.SerpParams{
 		Query:       q.Get("q"),
 		Slot:        q.Get("slot"),
-		CountryCode: q.Get("cc"),
+		CountryCode: utils.GetCountryCode(r),
 		KeywordID:   q.Get("kid"),
 		PublisherID: q.Get("pid"),
+		Domain:      q.Get("d"),
+	}
+
+	// Keyword links are signed by the render; a forged one would otherwise
+	// count a keyword click and hand out signed ad links for any publisher
+	verdict, ok := h.signer.Check("serp", q)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "<h2>403 – Invalid or expired link</h2>")
+		return
 	}
 
 	clientIP := utils.GetClientIP(r)
 	publisherID := utils.AtoiOrZero(params.PublisherID)
 	keywordID := utils.AtoiOrZero(params.KeywordID)
 
-	rule := config.GetRuleByPublisherIDAndUserAgent(publisherID, userAgent)
+	rule := config.GetRuleForRequest(config.RuleContext{
+		PublisherID: publisherID,
+		UserAgent:   userAgent,
+		CountryCode: params.CountryCode,
+		Domain:      params.Domain,
+		Slot:        params.Slot,
+		Referrer:    r.Referer(),
+		Now:         time.Now(),
+	})
 
 	if rule.Action.Block {
 		w.WriteHeader(http.StatusForbidden)
@@ -52,38 +75,91 @@ func (h *SerpHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Record keyword click (ignore DB errors)
-	if publisherID > 0 && db.GetDB() != nil {
-		db.GetDB().Exec(
-			`INSERT INTO keyword_click (publisher_id, keyword_id, keyword_title, slot, client_ip, user_agent, country_code) VALUES (?, ?, ?, ?, ?, ?, ?)`,
-			publisherID, keywordID, params.Query, params.Slot, clientIP, userAgent, params.CountryCode,
-		)
+	throttled := checkThrottle(h.throttler, r, rule, publisherID, params.CountryCode, "serp")
+	if throttled == config.ThrottleFallbackEmpty {
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 
-	// Get template path, fallback to dummy
-	serpTemplatePath := "storage/html/" + rule.Action.SerpTemplateID
-	maxAds := utils.CountAdSlots(serpTemplatePath)
-	if maxAds == 0 {
-		serpTemplatePath = dummySerpTemplate
-		maxAds = 3
+	action, experimentID, variantID := applyExperiment(w, r, rule.Action)
+
+	// The render that linked here, and a fresh id for this SERP view that
+	// its ad impressions and clicks carry
+	trace := db.Trace{RenderID: utils.RequestIDParam(q.Get("rid")), SerpID: utils.NewRequestID()}
+	visitor := db.Visitor{ClientIP: clientIP, UserAgent: userAgent, CountryCode: params.CountryCode}
+	variant := db.Variant{ExperimentID: experimentID, VariantID: variantID}
+
+	// Record keyword click; throttled traffic is counted in throttle_event
+	// instead
+	if throttled == "" && publisherID > 0 {
+		db.RecordEvent(db.KeywordClick{
+			Trace:        trace,
+			PublisherID:  publisherID,
+			KeywordID:    keywordID,
+			KeywordTitle: params.Query,
+			Slot:         params.Slot,
+			Visitor:      visitor,
+			Variant:      variant,
+			SigVerdict:   verdict,
+		})
 	}
 
-	var ads []models.YahooAd
+	serpTemplatePath, maxAds := resolveSerpTemplate(action)
+	if throttled == config.ThrottleFallbackDummy {
+		serpTemplatePath, maxAds = dummySerpTemplate, 3
+	}
+
+	var ads []models.Ad
 	if !isBot {
-		// FetchAds returns defaults on error
-		ads, _ = h.yahooService.FetchAds()
+		if throttled != "" {
+			// Throttled traffic never reaches the ads API
+			ads = services.DefaultAds
+		} else {
+			// Run returns defaults when no feed has ads; the result is
+			// ranked and capped at maxAds
+			ads = h.auction.Run(r.Context(), adSources(action), models.AdRequest{
+				Query:       params.Query,
+				CountryCode: params.CountryCode,
+				PublisherID: params.PublisherID,
+				ClientIP:    clientIP,
+				UserAgent:   userAgent,
+				PageURL:     utils.GetScheme(r) + "://" + r.Host + r.URL.RequestURI(),
+				MaxCount:    maxAds,
+			})
+		}
 
 		if len(ads) > maxAds {
 			ads = ads[:maxAds]
 		}
 
-		// Record ad impressions (ignore DB errors)
-		if db.GetDB() != nil {
+		// Record ad impressions and let the feeds count theirs; Position
+		// is our slot, ProviderRank the feed's
+		if throttled == "" {
+			if len(ads) > 0 {
+				h.quality.RecordImpression(trace.SerpID)
+			}
 			for pos, ad := range ads {
-				db.GetDB().Exec(
-					`INSERT INTO ad_impression (publisher_id, keyword_id, keyword_title, ad_position, ad_title, ad_host, client_ip, user_agent, country_code) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-					publisherID, keywordID, params.Query, pos+1, string(ad.TitleHTML), ad.Host, clientIP, userAgent, params.CountryCode,
-				)
+				db.RecordEvent(db.AdImpression{
+					Trace:        trace,
+					PublisherID:  publisherID,
+					KeywordID:    keywordID,
+					KeywordTitle: params.Query,
+					Position:     pos + 1,
+					ProviderRank: ad.Rank,
+					AdTitle:      string(ad.Title),
+					AdHost:       ad.DisplayURL,
+					AdProvider:   ad.Provider,
+					Visitor:      visitor,
+					Variant:      variant,
+					SigVerdict:   verdict,
+				})
+			}
+		}
+		if throttled == "" && h.beacons != nil {
+			for _, ad := range ads {
+				if ad.ImpressionURL != "" {
+					h.beacons.Fire(ad.ImpressionURL, userAgent)
+				}
 			}
 		}
 	}
@@ -94,23 +170,54 @@ func (h *SerpHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var adsVM []models.AdViewModel
-	for _, ad := range ads {
+	for pos, ad := range ads {
 		qs := url.Values{}
-		qs.Set("u", ad.Link)
 		qs.Set("slot", params.Slot)
 		qs.Set("kid", params.KeywordID)
 		qs.Set("q", params.Query)
-		qs.Set("adhost", ad.Host)
-		qs.Set("adtitle", string(ad.TitleHTML))
+		qs.Set("adhost", ad.DisplayURL)
+		qs.Set("adtitle", string(ad.Title))
+		if ad.Provider != "" {
+			qs.Set("prov", ad.Provider)
+		}
 		qs.Set("pid", params.PublisherID)
+		if params.Domain != "" {
+			qs.Set("d", params.Domain)
+		}
 		qs.Set("cc", params.CountryCode)
+		qs.Set("pos", strconv.Itoa(pos+1))
+		if trace.RenderID != "" {
+			qs.Set("rid", trace.RenderID)
+		}
+		qs.Set("sid", trace.SerpID)
+		if variantID != "" {
+			qs.Set("exp", experimentID)
+			qs.Set("var", variantID)
+		}
+
+		// House ads on throttled pages are not tracked
+		tracked := throttled == ""
+
+		if ad.Rank > 0 {
+			qs.Set("prank", strconv.Itoa(ad.Rank))
+		}
+
+		var sitelinks []models.SitelinkViewModel
+		for i, sl := range ad.Sitelinks {
+			sitelinks = append(sitelinks, models.SitelinkViewModel{
+				Text:      sl.Text,
+				ClickHref: h.adClickHref(qs, sl.URL, i+1, tracked),
+			})
+		}
 
 		adsVM = append(adsVM, models.AdViewModel{
-			TitleHTML:   ad.TitleHTML,
-			DescHTML:    ad.DescHTML,
-			Host:        ad.Host,
-			ClickHref:   "/ad-click?" + qs.Encode(),
+			Title:       ad.Title,
+			Description: ad.Description,
+			DisplayURL:  ad.DisplayURL,
+			Provider:    ad.Provider,
+			ClickHref:   h.adClickHref(qs, ad.ClickURL, 0, tracked),
 			RenderLinks: !isBot,
+			Sitelinks:   sitelinks,
 		})
 	}
 
@@ -122,9 +229,10 @@ func (h *SerpHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 	for i, ad := range adsVM {
 		idx := strconv.Itoa(i + 1)
-		dataMap["AdTitle"+idx] = ad.TitleHTML
-		dataMap["AdDesc"+idx] = ad.DescHTML
+		dataMap["AdTitle"+idx] = ad.Title
+		dataMap["AdDesc"+idx] = ad.Description
 		dataMap["AdHref"+idx] = ad.ClickHref
+		dataMap["AdSitelinks"+idx] = ad.Sitelinks
 	}
 
 	tmpl, err := template.ParseFiles(serpTemplatePath)
@@ -140,3 +248,43 @@ func (h *SerpHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		log.Printf("template execute error: %v", err)
 	}
 }
+
+// adClickHref returns the /ad-click URL that logs a click on target and
+// redirects to it. base holds the ad's tracking params; sitelink is the
+// 1-based sitelink position, or 0 for the ad's main link. The link is signed
+// so /ad-click can trust it. Untracked links go straight to target.
+func (h *SerpHandler) adClickHref(base url.Values, target string, sitelink int, tracked bool) string {
+	if !tracked {
+		return target
+	}
+	qs := url.Values{}
+	for k, v := range base {
+		qs[k] = v
+	}
+	qs.Set("u", target)
+	if sitelink > 0 {
+		qs.Set("sl", strconv.Itoa(sitelink))
+	}
+	h.signer.Sign(qs)
+	return "/ad-click?" + qs.Encode()
+}
+
+// adSources converts the rule's ad provider list for the auction.
+func adSources(action config.RuleAction) []services.AdSource {
+	var sources []services.AdSource
+	for _, p := range action.AdProviders {
+		sources = append(sources, services.AdSource{Name: p.Name, Weight: p.Weight})
+	}
+	return sources
+}
+
+// resolveSerpTemplate returns the SERP template to render and how many ads
+// it holds, falling back to the dummy template when the rule's template is
+// missing or has no ad slots.
+func resolveSerpTemplate(action config.RuleAction) (string, int) {
+	path := templateDir + action.SerpTemplateID
+	if n := utils.CountAdSlots(path); n > 0 {
+		return path, n
+	}
+	return dummySerpTemplate, 3
+}
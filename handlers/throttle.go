@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"net/http"
+
+	"adserving/config"
+	"adserving/db"
+	"adserving/services"
+	"adserving/utils"
+)
+
+// checkThrottle applies the rule's throttle settings. It returns the
+// fallback to serve ("dummy", "empty" or "house") when the request is shed,
+// or "" to serve it normally. Shed requests are logged to throttle_event
+// instead of the regular tracking tables.
+func checkThrottle(t *services.Throttler, r *http.Request, rule config.Rule, publisherID int, countryCode, endpoint string) string {
+	a := rule.Action
+	if t == nil || publisherID == 0 || (a.ThrottlePercent <= 0 && a.QPSCap <= 0) {
+		return ""
+	}
+
+	ok, reason := t.Allow(publisherID, a.ThrottlePercent, a.QPSCap)
+	if ok {
+		return ""
+	}
+
+	fallback := a.ThrottleFallback
+	if fallback == "" {
+		fallback = config.ThrottleFallbackDummy
+	}
+
+	db.RecordEvent(db.ThrottleEvent{
+		PublisherID: publisherID,
+		RuleID:      rule.ID,
+		Endpoint:    endpoint,
+		Reason:      reason,
+		Fallback:    fallback,
+		Visitor:     db.Visitor{ClientIP: utils.GetClientIP(r), UserAgent: r.UserAgent(), CountryCode: countryCode},
+	})
+	return fallback
+}
@@ -1,39 +1,218 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"adserving/config"
 	"adserving/db"
 	"adserving/handlers"
 	"adserving/services"
+	"adserving/utils"
 )
 
 func main() {
 	cfg := config.Load()
 
+	if runCLI(cfg, os.Args[1:]) {
+		return
+	}
+
 	if err := db.Init(cfg.DBDsn); err != nil {
 		log.Fatalf("DB init error: %v", err)
 	}
 	defer db.Close()
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	spool, err := db.OpenSpool(cfg.EventSpoolDir, int64(cfg.EventSpoolSegmentBytes))
+	if err != nil {
+		log.Fatalf("event spool error: %v", err)
+	}
+	defer spool.Close()
+	spool.StartReplayer(ctx, db.GetDB(), cfg.EventSpoolReplayInterval)
+
+	db.StartEventWriter(db.EventWriterOptions{
+		QueueSize:     cfg.EventQueueSize,
+		Workers:       cfg.EventWorkers,
+		BatchSize:     cfg.EventBatchSize,
+		FlushInterval: cfg.EventFlushInterval,
+		Policy:        cfg.EventQueuePolicy,
+		BlockTimeout:  cfg.EventBlockTimeout,
+		Spool:         spool,
+	})
+
 	config.SetRulesDB(db.GetDB())
+	config.StartRuleReloader(ctx, cfg.RulesPollInterval, cfg.RulesRefreshInterval)
+
+	keywordClient := services.NewResilientClient("keyword_api", services.ResilientOptions{
+		Timeout:          cfg.KeywordAPITimeout,
+		MaxRetries:       cfg.UpstreamRetries,
+		RetryBackoff:     100 * time.Millisecond,
+		BreakerThreshold: cfg.BreakerThreshold,
+		BreakerCooldown:  cfg.BreakerCooldown,
+	})
+	adsClient := services.NewResilientClient("ads_api", services.ResilientOptions{
+		Timeout:          cfg.AdsAPITimeout,
+		MaxRetries:       cfg.UpstreamRetries,
+		RetryBackoff:     100 * time.Millisecond,
+		BreakerThreshold: cfg.BreakerThreshold,
+		BreakerCooldown:  cfg.BreakerCooldown,
+	})
+
+	keywordProviders := services.NewKeywordProviders(services.KeywordProviderAPI)
+	var apiProvider services.KeywordProvider = services.NewKeywordService(cfg.APIBaseURL, keywordClient)
+	if cfg.KeywordCacheTTL > 0 {
+		apiProvider = services.NewCachingKeywordProvider(apiProvider, cfg.KeywordCacheTTL, 10000, cfg.KeywordAPITimeout)
+	}
+	keywordProviders.Register(services.KeywordProviderAPI, apiProvider)
+	keywordProviders.Register(services.KeywordProviderCurated, services.NewCuratedKeywordProvider(db.GetDB()))
+	if cfg.KeywordStaticFile != "" {
+		staticProvider, err := services.NewStaticKeywordProvider(cfg.KeywordStaticFile)
+		if err != nil {
+			log.Fatalf("static keyword file error: %v", err)
+		}
+		keywordProviders.Register(services.KeywordProviderStatic, staticProvider)
+	}
 
-	keywordService := services.NewKeywordService(cfg.APIBaseURL)
-	yahooService := services.NewYahooService()
+	adProviders := services.NewAdProviders()
+	adProviders.Register(services.AdProviderYahoo, services.NewYahooService(cfg.AdsAPIBaseURL, cfg.AdsPartner, cfg.AdsSourceTag, adsClient))
+	if cfg.AdsJSONAPIBaseURL != "" {
+		jsonAdsClient := services.NewResilientClient("ads_json_api", services.ResilientOptions{
+			Timeout:          cfg.AdsAPITimeout,
+			MaxRetries:       cfg.UpstreamRetries,
+			RetryBackoff:     100 * time.Millisecond,
+			BreakerThreshold: cfg.BreakerThreshold,
+			BreakerCooldown:  cfg.BreakerCooldown,
+		})
+		adProviders.Register(services.AdProviderJSON, services.NewJSONAdService(cfg.AdsJSONAPIBaseURL, jsonAdsClient))
+	}
+	adAuction := services.NewAdAuction(adProviders, cfg.AdsAuctionTimeout)
+	beacons := services.NewBeaconService(4, 1000, cfg.AdsAPITimeout)
 	clickService := services.NewClickService()
+	throttler := services.NewThrottler()
 
-	renderHandler := handlers.NewRenderHandler(keywordService)
-	serpHandler := handlers.NewSerpHandler(yahooService)
-	adClickHandler := handlers.NewAdClickHandler(clickService)
+	signingKeys, err := services.ParseSigningKeys(cfg.TrackingKeys)
+	if err != nil {
+		log.Fatalf("TRACKING_KEYS error: %v", err)
+	}
+	switch cfg.TrackingSignatureMode {
+	case services.SignatureModeFlag, services.SignatureModeEnforce:
+	default:
+		log.Fatalf("unknown TRACKING_SIGNATURE_MODE %q", cfg.TrackingSignatureMode)
+	}
+	signer, err := services.NewURLSigner(signingKeys, cfg.TrackingLinkTTL, cfg.TrackingSignatureMode == services.SignatureModeEnforce)
+	if err != nil {
+		log.Fatalf("TRACKING_KEYS error: %v", err)
+	}
 
-	http.HandleFunc("/firstcall.js", handlers.HandleFirstCallJS)
-	http.HandleFunc("/keyword_render", renderHandler.Handle)
-	http.HandleFunc("/keyword_impression", handlers.HandleKeywordImpression)
-	http.HandleFunc("/serp", serpHandler.Handle)
-	http.HandleFunc("/ad-click", adClickHandler.Handle)
+	if err := utils.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("TRUSTED_PROXIES error: %v", err)
+	}
 
-	log.Printf("Server starting on %s", cfg.ServerAddr)
-	log.Fatal(http.ListenAndServe(cfg.ServerAddr, nil))
+	var datacenterRanges []*net.IPNet
+	if cfg.ClickDatacenterRanges != "" {
+		datacenterRanges, err = services.LoadIPRanges(cfg.ClickDatacenterRanges)
+		if err != nil {
+			log.Fatalf("datacenter ranges error: %v", err)
+		}
+	}
+	clickQuality := services.NewClickQuality(services.ClickQualityOptions{
+		DedupeWindow:     cfg.ClickDedupeWindow,
+		VelocityWindow:   cfg.ClickVelocityWindow,
+		IPClickLimit:     cfg.ClickIPLimit,
+		IPUAClickLimit:   cfg.ClickIPUALimit,
+		MinClickDelay:    cfg.ClickMinDelay,
+		ImpressionTTL:    cfg.ClickImpressionTTL,
+		DatacenterRanges: datacenterRanges,
+	})
+
+	renderHandler := handlers.NewRenderHandler(keywordProviders, throttler, signer)
+	serpHandler := handlers.NewSerpHandler(adAuction, beacons, throttler, signer, clickQuality)
+	adClickHandler := handlers.NewAdClickHandler(clickService, signer, clickQuality)
+	impressionHandler := handlers.NewImpressionHandler(signer)
+	adminHandler := handlers.NewAdminHandler(cfg.AdminToken)
+
+	// Public traffic gets its own mux: importing expvar registers
+	// /debug/vars on http.DefaultServeMux, which is only served on the
+	// metrics listener.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/firstcall.js", handlers.HandleFirstCallJS)
+	mux.HandleFunc("/keyword_render", renderHandler.Handle)
+	mux.HandleFunc("/keyword_impression", impressionHandler.Handle)
+	mux.HandleFunc("/serp", serpHandler.Handle)
+	mux.HandleFunc("/ad-click", adClickHandler.Handle)
+	mux.HandleFunc("/admin/rules", adminHandler.Handle)
+	mux.HandleFunc("/admin/rules/", adminHandler.Handle)
+
+	var metricsSrv *http.Server
+	if cfg.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/debug/vars", expvar.Handler())
+		metricsSrv = &http.Server{Addr: cfg.MetricsAddr, Handler: metricsMux}
+		go func() {
+			log.Printf("Metrics listening on %s", cfg.MetricsAddr)
+			if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("metrics server error: %v", err)
+			}
+		}()
+	}
+
+	// Request contexts derive from baseCtx so that requests still running
+	// when the shutdown grace period ends are canceled, upstream calls and
+	// DB writes included.
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv := &http.Server{
+		Addr:        cfg.ServerAddr,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("Server starting on %s", cfg.ServerAddr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server error: %v", err)
+		}
+		return
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("graceful shutdown incomplete: %v, canceling remaining requests", err)
+		cancelRequests()
+		srv.Close()
+	}
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+	if err := beacons.Close(shutdownCtx); err != nil {
+		log.Printf("impression beacons not all sent: %v", err)
+	}
+
+	// The drain gets its own budget so events queued by the last requests
+	// are written even when the request grace period ran out.
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelDrain()
+	if err := db.StopEventWriter(drainCtx); err != nil {
+		log.Printf("event writer drain incomplete: %v", err)
+	}
 }
@@ -14,40 +14,29 @@ type KeywordResponse struct {
 	Keywords []KeywordItem `json:"k"`
 }
 
-type YahooResults struct {
-	ResultSet struct {
-		Listings []YahooListing `xml:"Listing"`
-	} `xml:"ResultSet"`
+// Ad is one sponsored result, whichever feed it came from. Feed adapters in
+// services convert their own response formats into it.
+type Ad struct {
+	Title       template.HTML
+	Description template.HTML
+	// DisplayURL is the advertiser host shown with the ad; ClickURL is the
+	// feed's billable click link.
+	DisplayURL string
+	ClickURL   string
+	// Provider is the feed the ad came from, Rank its position in that
+	// feed (1-based) and Bid the price it reported, 0 if none.
+	Provider string
+	Rank     int
+	Bid      float64
+	// Sitelinks are the extra links (action extensions) the feed attached.
+	Sitelinks []AdSitelink
+	// ImpressionURL, if set, is the feed's beacon for when the ad is shown.
+	ImpressionURL string
 }
 
-type YahooListing struct {
-	Rank        string     `xml:"rank,attr"`
-	Title       string     `xml:"title,attr"`
-	Description string     `xml:"description,attr"`
-	SiteHost    string     `xml:"siteHost,attr"`
-	ClickUrl    YahooClick `xml:"ClickUrl"`
-	Extensions  YahooExt   `xml:"Extensions"`
-}
-
-type YahooExt struct {
-	ActionExtension struct {
-		Items []struct {
-			Text string `xml:"text"`
-			Link string `xml:"link"`
-		} `xml:"actionItem"`
-	} `xml:"actionExtension"`
-}
-
-type YahooClick struct {
-	Type string `xml:"type,attr"`
-	URL  string `xml:",chardata"`
-}
-
-type YahooAd struct {
-	TitleHTML template.HTML
-	DescHTML  template.HTML
-	Link      string
-	Host      string
+type AdSitelink struct {
+	Text string
+	URL  string
 }
 
 type ClickStatKey struct {
@@ -68,6 +57,22 @@ type RenderParams struct {
 	PageTitle    string
 	ReferrerURL  string
 	KeywordRef   string
+	// PartnerParams are sent to the keyword API verbatim, before the
+	// request-derived parameters.
+	PartnerParams map[string]string
+}
+
+// AdRequest is what the ads provider is asked for on one SERP view.
+type AdRequest struct {
+	Query       string
+	CountryCode string
+	PublisherID string
+	ClientIP    string
+	UserAgent   string
+	// PageURL is the URL of the page the ads will be shown on.
+	PageURL string
+	// MaxCount is the number of ad slots in the SERP template.
+	MaxCount int
 }
 
 type SerpParams struct {
@@ -76,12 +81,20 @@ type SerpParams struct {
 	CountryCode string
 	KeywordID   string
 	PublisherID string
+	Domain      string
 }
 
 type AdViewModel struct {
-	TitleHTML   template.HTML
-	DescHTML    template.HTML
-	Host        string
+	Title       template.HTML
+	Description template.HTML
+	DisplayURL  string
+	Provider    string
 	ClickHref   string
 	RenderLinks bool
+	Sitelinks   []SitelinkViewModel
+}
+
+type SitelinkViewModel struct {
+	Text      string
+	ClickHref string
 }
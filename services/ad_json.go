@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"adserving/models"
+)
+
+// jsonAdResponse is the JSON feed's answer:
+// {"ads":[{"title":"..","description":"..","click_url":"..","display_url":"..","bid":0.42,
+// "impression_url":"..","sitelinks":[{"text":"..","url":".."}]}]}
+type jsonAdResponse struct {
+	Ads []struct {
+		Title         string  `json:"title"`
+		Description   string  `json:"description"`
+		ClickURL      string  `json:"click_url"`
+		DisplayURL    string  `json:"display_url"`
+		Bid           float64 `json:"bid"`
+		ImpressionURL string  `json:"impression_url"`
+		Sitelinks     []struct {
+			Text string `json:"text"`
+			URL  string `json:"url"`
+		} `json:"sitelinks"`
+	} `json:"ads"`
+}
+
+// JSONAdService reads ads from a generic JSON feed that prices each ad.
+// Titles and descriptions are plain text and are escaped here.
+type JSONAdService struct {
+	baseURL string
+	client  *ResilientClient
+}
+
+func NewJSONAdService(baseURL string, client *ResilientClient) *JSONAdService {
+	return &JSONAdService{baseURL: baseURL, client: client}
+}
+
+func (s *JSONAdService) FetchAds(ctx context.Context, req models.AdRequest) ([]models.Ad, error) {
+	q := url.Values{}
+	q.Set("q", req.Query)
+	q.Set("cc", req.CountryCode)
+	q.Set("pid", req.PublisherID)
+	if req.MaxCount > 0 {
+		q.Set("n", strconv.Itoa(req.MaxCount))
+	}
+	if req.ClientIP != "" {
+		q.Set("ip", req.ClientIP)
+	}
+	if req.UserAgent != "" {
+		q.Set("ua", req.UserAgent)
+	}
+	if req.PageURL != "" {
+		q.Set("url", req.PageURL)
+	}
+
+	body, err := s.client.Get(ctx, s.baseURL+"?"+q.Encode(), http.Header{
+		"User-Agent": {"AdService/1.0"},
+		"Accept":     {"application/json"},
+	})
+	if err != nil {
+		log.Printf("json ads fetch error: %v, using defaults", err)
+		return DefaultAds, err
+	}
+
+	var resp jsonAdResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		log.Printf("json ads parse error: %v, using defaults", err)
+		return DefaultAds, fmt.Errorf("json decode: %w", err)
+	}
+
+	var ads []models.Ad
+	for _, a := range resp.Ads {
+		link := strings.TrimSpace(a.ClickURL)
+		title := strings.TrimSpace(a.Title)
+		if link == "" || title == "" {
+			continue
+		}
+		host := strings.TrimSpace(a.DisplayURL)
+		if u, err := url.Parse(host); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		var sitelinks []models.AdSitelink
+		for _, sl := range a.Sitelinks {
+			if text, u := strings.TrimSpace(sl.Text), strings.TrimSpace(sl.URL); text != "" && u != "" {
+				sitelinks = append(sitelinks, models.AdSitelink{Text: text, URL: u})
+			}
+		}
+		ads = append(ads, models.Ad{
+			Title:         template.HTML(html.EscapeString(title)),
+			Description:   template.HTML(html.EscapeString(strings.TrimSpace(a.Description))),
+			DisplayURL:    host,
+			ClickURL:      link,
+			Rank:          len(ads) + 1,
+			Bid:           a.Bid,
+			Sitelinks:     sitelinks,
+			ImpressionURL: strings.TrimSpace(a.ImpressionURL),
+		})
+	}
+
+	if len(ads) == 0 {
+		return DefaultAds, ErrNoAds
+	}
+	return ads, nil
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"html/template"
+
+	"adserving/models"
+)
+
+// Names under which ad feeds are registered; a rule action lists the ones
+// to auction in ad_providers.
+const (
+	AdProviderYahoo = "yahoo"
+	AdProviderJSON  = "json"
+)
+
+// DefaultAds are shown when no feed has ads for a request.
+var DefaultAds = []models.Ad{
+	{
+		Title:       template.HTML("Shop Top Deals Today"),
+		Description: template.HTML("Find amazing discounts on popular products. Limited time offers available now."),
+		DisplayURL:  "example.com",
+		ClickURL:    "https://example.com/deals",
+	},
+	{
+		Title:       template.HTML("Compare Best Prices"),
+		Description: template.HTML("Get the best prices from trusted retailers. Save money on your next purchase."),
+		DisplayURL:  "example.com",
+		ClickURL:    "https://example.com/compare",
+	},
+	{
+		Title:       template.HTML("Exclusive Online Offers"),
+		Description: template.HTML("Special offers only available online. Don't miss out on these savings."),
+		DisplayURL:  "example.com",
+		ClickURL:    "https://example.com/offers",
+	},
+}
+
+// ErrNoAds is returned, along with the defaults, when a feed has no ads for
+// the request.
+var ErrNoAds = errors.New("no ads")
+
+// AdProvider is one ad feed. Like the keyword providers, implementations
+// return DefaultAds together with the error when they have nothing to
+// offer, including when ctx ends before they finish.
+type AdProvider interface {
+	FetchAds(ctx context.Context, req models.AdRequest) ([]models.Ad, error)
+}
+
+// AdProviders is the set of configured ad feeds, looked up by name.
+type AdProviders struct {
+	providers map[string]AdProvider
+}
+
+func NewAdProviders() *AdProviders {
+	return &AdProviders{providers: make(map[string]AdProvider)}
+}
+
+func (p *AdProviders) Register(name string, provider AdProvider) {
+	p.providers[name] = provider
+}
+
+func (p *AdProviders) Get(name string) (AdProvider, bool) {
+	provider, ok := p.providers[name]
+	return provider, ok
+}
+
+// KnownAdProvider reports whether name is a feed this codebase implements,
+// whether or not it is configured.
+func KnownAdProvider(name string) bool {
+	switch name {
+	case AdProviderYahoo, AdProviderJSON:
+		return true
+	}
+	return false
+}
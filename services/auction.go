@@ -0,0 +1,170 @@
+package services
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"adserving/models"
+)
+
+// adAuctionStats is published at /debug/vars as "ad_auction".
+var adAuctionStats = expvar.NewMap("ad_auction")
+
+// AdSource is one feed taking part in an auction and the weight applied to
+// its bids.
+type AdSource struct {
+	Name   string
+	Weight float64
+}
+
+// AdAuction calls several ad feeds in parallel and merges their ads into a
+// single ranking.
+type AdAuction struct {
+	providers *AdProviders
+	timeout   time.Duration
+}
+
+// NewAdAuction returns an auction over providers. Feeds that have not
+// answered within timeout are left out of the ranking.
+func NewAdAuction(providers *AdProviders, timeout time.Duration) *AdAuction {
+	return &AdAuction{providers: providers, timeout: timeout}
+}
+
+type auctionResult struct {
+	source AdSource
+	order  int
+	ads    []models.Ad
+	err    error
+}
+
+// Run auctions req across sources (the Yahoo feed alone when empty) and
+// returns at most req.MaxCount ads, best first. Ads are ranked by weighted
+// bid; ads without a bid follow, by source weight and then by their rank in
+// their own feed. Only the best ad per landing host is kept. When no feed
+// answers with ads, Run returns DefaultAds.
+func (a *AdAuction) Run(ctx context.Context, sources []AdSource, req models.AdRequest) []models.Ad {
+	if len(sources) == 0 {
+		sources = []AdSource{{Name: AdProviderYahoo, Weight: 1}}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	results := make(chan auctionResult, len(sources))
+	pending := 0
+	for i, src := range sources {
+		provider, ok := a.providers.Get(src.Name)
+		if !ok {
+			log.Printf("ad provider %q not configured, skipping", src.Name)
+			continue
+		}
+		pending++
+		go func(src AdSource, order int, provider AdProvider) {
+			ads, err := provider.FetchAds(ctx, req)
+			results <- auctionResult{source: src, order: order, ads: ads, err: err}
+		}(src, i, provider)
+	}
+
+	var collected []auctionResult
+wait:
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				adAuctionStats.Add(res.source.Name+"_errors", 1)
+				continue
+			}
+			collected = append(collected, res)
+		case <-ctx.Done():
+			adAuctionStats.Add("deadline_exceeded", int64(pending))
+			break wait
+		}
+	}
+
+	ads := rankAds(collected)
+	if len(ads) == 0 {
+		adAuctionStats.Add("fallbacks", 1)
+		ads = DefaultAds
+	}
+	if req.MaxCount > 0 && len(ads) > req.MaxCount {
+		ads = ads[:req.MaxCount]
+	}
+	return ads
+}
+
+type rankedAd struct {
+	ad     models.Ad
+	score  float64
+	weight float64
+	order  int
+}
+
+func rankAds(results []auctionResult) []models.Ad {
+	var candidates []rankedAd
+	for _, res := range results {
+		for i, ad := range res.ads {
+			ad.Provider = res.source.Name
+			if ad.Rank <= 0 {
+				ad.Rank = i + 1
+			}
+			candidates = append(candidates, rankedAd{
+				ad:     ad,
+				score:  ad.Bid * res.source.Weight,
+				weight: res.source.Weight,
+				order:  res.order,
+			})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if a.weight != b.weight {
+			return a.weight > b.weight
+		}
+		if a.order != b.order {
+			return a.order < b.order
+		}
+		return a.ad.Rank < b.ad.Rank
+	})
+
+	seen := make(map[string]bool)
+	var ads []models.Ad
+	for _, c := range candidates {
+		if host := landingHost(c.ad); host != "" {
+			if seen[host] {
+				continue
+			}
+			seen[host] = true
+		}
+		ads = append(ads, c.ad)
+	}
+	return ads
+}
+
+// landingHost is the advertiser host an ad leads to, from its display URL
+// or, failing that, its click URL, without port or leading "www.".
+func landingHost(ad models.Ad) string {
+	host := strings.TrimSpace(ad.DisplayURL)
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if host == "" {
+		if u, err := url.Parse(ad.ClickURL); err == nil {
+			host = u.Host
+		}
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimPrefix(strings.ToLower(host), "www.")
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// beaconStats is published at /debug/vars as "beacons".
+var beaconStats = expvar.NewMap("beacons")
+
+// maxBeaconRedirects bounds the redirects followed for one beacon.
+const maxBeaconRedirects = 5
+
+// sharedAddressSpace is the carrier-grade NAT range, 100.64.0.0/10.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+type beacon struct {
+	url       string
+	userAgent string
+}
+
+// BeaconService fires ad feeds' impression beacons in the background so
+// their impression counts match ours. Beacons are sent with the viewer's
+// user agent, and only to public addresses, redirects included, since the
+// URLs come from the feed; when the queue is full they are dropped rather
+// than slowing down the SERP.
+type BeaconService struct {
+	client *http.Client
+	queue  chan beacon
+	wg     sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewBeaconService(workers, queueSize int, timeout time.Duration) *BeaconService {
+	dialer := &net.Dialer{Timeout: timeout, Control: refuseNonPublic}
+	s := &BeaconService{
+		client: &http.Client{
+			Transport:     &http.Transport{DialContext: dialer.DialContext, MaxIdleConnsPerHost: workers},
+			Timeout:       timeout,
+			CheckRedirect: checkBeaconRedirect,
+		},
+		queue: make(chan beacon, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go s.worker()
+	}
+	return s
+}
+
+// Fire queues a beacon request for rawURL. Beacons fired after Close are
+// dropped.
+func (s *BeaconService) Fire(rawURL, userAgent string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		beaconStats.Add("dropped", 1)
+		return
+	}
+	select {
+	case s.queue <- beacon{url: rawURL, userAgent: userAgent}:
+	default:
+		beaconStats.Add("dropped", 1)
+	}
+}
+
+// Close stops accepting beacons and waits until the queued ones have been
+// sent or ctx is done.
+func (s *BeaconService) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *BeaconService) worker() {
+	defer s.wg.Done()
+	for b := range s.queue {
+		s.send(b)
+	}
+}
+
+func (s *BeaconService) send(b beacon) {
+	req, err := http.NewRequest(http.MethodGet, b.url, nil)
+	if err == nil {
+		err = checkBeaconScheme(req)
+	}
+	if err != nil {
+		beaconStats.Add("failed", 1)
+		log.Printf("beacon %q: %v", b.url, err)
+		return
+	}
+	if b.userAgent != "" {
+		req.Header.Set("User-Agent", b.userAgent)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		beaconStats.Add("failed", 1)
+		log.Printf("beacon %q: %v", b.url, err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		beaconStats.Add("failed", 1)
+		log.Printf("beacon %q: status %d", b.url, resp.StatusCode)
+		return
+	}
+	beaconStats.Add("fired", 1)
+}
+
+func checkBeaconScheme(req *http.Request) error {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", req.URL.Scheme)
+	}
+	return nil
+}
+
+func checkBeaconRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxBeaconRedirects {
+		return errors.New("too many redirects")
+	}
+	return checkBeaconScheme(req)
+}
+
+// refuseNonPublic is a dialer Control hook that refuses connections to
+// loopback, private, link-local and other non-public addresses. It runs
+// after name resolution, for every connection, so neither a hostname nor a
+// redirect can reach our own network.
+func refuseNonPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("refusing non-public address %s", host)
+	}
+	return nil
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip))
+}
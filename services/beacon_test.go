@@ -0,0 +1,55 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBeaconRefusesInternalAddresses(t *testing.T) {
+	var hits int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer internal.Close()
+
+	s := NewBeaconService(1, 10, time.Second)
+	s.Fire(internal.URL+"/pixel", "Mozilla/5.0")
+	s.Fire(fmt.Sprintf("http://localhost:%d/pixel", internal.Listener.Addr().(*net.TCPAddr).Port), "Mozilla/5.0")
+	s.Fire("file:///etc/passwd", "Mozilla/5.0")
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("internal server got %d beacon requests, want none", n)
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"8.8.8.8":         true,
+		"2001:4860::8888": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"fc00::1":         false,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": false,
+	}
+	for addr, want := range tests {
+		if got := isPublicIP(net.ParseIP(addr)); got != want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package services
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clickQualityStats is published at /debug/vars as "click_quality".
+var clickQualityStats = expvar.NewMap("click_quality")
+
+// Click quality signals, stored comma-separated in ad_click.click_reasons.
+const (
+	ClickReasonNoImpression   = "no_impression"
+	ClickReasonFastClick      = "fast_click"
+	ClickReasonIPVelocity     = "ip_velocity"
+	ClickReasonIPUAVelocity   = "ip_ua_velocity"
+	ClickReasonDatacenterIP   = "datacenter_ip"
+	ClickReasonHeadlessUA     = "headless_ua"
+	ClickReasonUnverifiedLink = "unverified_link"
+)
+
+// clickReasonScores is what each signal adds to a click's score, which is
+// capped at 100.
+var clickReasonScores = map[string]int{
+	ClickReasonNoImpression:   40,
+	ClickReasonFastClick:      30,
+	ClickReasonIPVelocity:     30,
+	ClickReasonIPUAVelocity:   20,
+	ClickReasonDatacenterIP:   40,
+	ClickReasonHeadlessUA:     50,
+	ClickReasonUnverifiedLink: 20,
+}
+
+// headlessUAMarkers are lowercase user agent fragments of headless browsers,
+// automation drivers and HTTP libraries.
+var headlessUAMarkers = []string{
+	"headlesschrome", "phantomjs", "slimerjs", "puppeteer", "playwright",
+	"selenium", "webdriver", "python-requests", "python-urllib", "curl/",
+	"wget/", "go-http-client", "okhttp", "java/", "libwww-perl",
+}
+
+type ClickQualityOptions struct {
+	// DedupeWindow is how long a repeat of the same click is ignored; 0
+	// disables deduplication.
+	DedupeWindow time.Duration
+	// Clicks from one IP (or IP and user agent) beyond these limits within
+	// VelocityWindow are flagged; 0 disables the check.
+	VelocityWindow time.Duration
+	IPClickLimit   int
+	IPUAClickLimit int
+	// Clicks sooner than MinClickDelay after the ad was shown are flagged.
+	MinClickDelay time.Duration
+	// ImpressionTTL is how long a served SERP is remembered.
+	ImpressionTTL time.Duration
+	// DatacenterRanges are networks real visitors do not click from.
+	DatacenterRanges []*net.IPNet
+}
+
+// ClickSignals describes one ad click for assessment.
+type ClickSignals struct {
+	RenderID  string
+	SerpID    string
+	ClientIP  string
+	UserAgent string
+	// Ad identifies the ad and link clicked within the SERP.
+	Ad string
+	// ShownAt is when the link was generated, taken from its signature; zero
+	// unless the signature is valid.
+	ShownAt time.Time
+	// LinkVerdict is the link's signature verdict.
+	LinkVerdict string
+}
+
+type ClickAssessment struct {
+	// Duplicate clicks repeat one seen within the dedupe window and are
+	// neither counted nor scored.
+	Duplicate bool
+	Score     int
+	Reasons   []string
+}
+
+// ClickQuality dedupes ad clicks and scores them for fraud signals. State is
+// kept in memory, per process: SERPs served by another instance are only
+// recognised through the signed time on their links.
+type ClickQuality struct {
+	opts ClickQualityOptions
+
+	mu          sync.Mutex
+	recent      map[string]time.Time
+	impressions map[string]time.Time
+	velocity    map[string]*clickWindow
+	lastSweep   time.Time
+}
+
+type clickWindow struct {
+	start time.Time
+	n     int
+}
+
+func NewClickQuality(opts ClickQualityOptions) *ClickQuality {
+	return &ClickQuality{
+		opts:        opts,
+		recent:      make(map[string]time.Time),
+		impressions: make(map[string]time.Time),
+		velocity:    make(map[string]*clickWindow),
+		lastSweep:   time.Now(),
+	}
+}
+
+// RecordImpression notes that the SERP view serpID showed ads.
+func (c *ClickQuality) RecordImpression(serpID string) {
+	if c == nil || serpID == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.impressions[serpID] = time.Now()
+}
+
+// Assess dedupes and scores a click. A nil ClickQuality passes every click
+// with a score of 0.
+func (c *ClickQuality) Assess(s ClickSignals) ClickAssessment {
+	if c == nil {
+		return ClickAssessment{}
+	}
+	now := time.Now()
+	var reasons []string
+
+	c.mu.Lock()
+	c.sweep(now)
+
+	// Bursts count towards velocity even when they dedupe away
+	if c.opts.VelocityWindow > 0 {
+		if c.opts.IPClickLimit > 0 && c.count("ip|"+s.ClientIP, now) > c.opts.IPClickLimit {
+			reasons = append(reasons, ClickReasonIPVelocity)
+		}
+		if c.opts.IPUAClickLimit > 0 && c.count("ipua|"+s.ClientIP+"|"+s.UserAgent, now) > c.opts.IPUAClickLimit {
+			reasons = append(reasons, ClickReasonIPUAVelocity)
+		}
+	}
+
+	if c.opts.DedupeWindow > 0 {
+		key := dedupeKey(s)
+		if at, ok := c.recent[key]; ok && now.Sub(at) < c.opts.DedupeWindow {
+			c.mu.Unlock()
+			clickQualityStats.Add("duplicates", 1)
+			return ClickAssessment{Duplicate: true}
+		}
+		c.recent[key] = now
+	}
+
+	shownAt, seen := c.impressions[s.SerpID]
+	c.mu.Unlock()
+
+	if !seen || s.SerpID == "" {
+		shownAt = s.ShownAt
+	}
+	if shownAt.IsZero() {
+		reasons = append(reasons, ClickReasonNoImpression)
+	} else if now.Sub(shownAt) < c.opts.MinClickDelay {
+		reasons = append(reasons, ClickReasonFastClick)
+	}
+
+	if c.isDatacenterIP(s.ClientIP) {
+		reasons = append(reasons, ClickReasonDatacenterIP)
+	}
+	if IsHeadlessUA(s.UserAgent) {
+		reasons = append(reasons, ClickReasonHeadlessUA)
+	}
+	if s.LinkVerdict != VerdictValid {
+		reasons = append(reasons, ClickReasonUnverifiedLink)
+	}
+
+	a := ClickAssessment{Reasons: reasons}
+	for _, r := range reasons {
+		a.Score += clickReasonScores[r]
+		clickQualityStats.Add("reason."+r, 1)
+	}
+	if a.Score > 100 {
+		a.Score = 100
+	}
+	clickQualityStats.Add("assessed", 1)
+	return a
+}
+
+// dedupeKey identifies a click on one ad link by one visitor, within the
+// render or SERP view it came from when known.
+func dedupeKey(s ClickSignals) string {
+	view := s.SerpID
+	if view == "" {
+		view = s.RenderID
+	}
+	return strings.Join([]string{view, s.ClientIP, s.UserAgent, s.Ad}, "|")
+}
+
+// count adds a click to key's fixed window and returns the clicks in it.
+// c.mu must be held.
+func (c *ClickQuality) count(key string, now time.Time) int {
+	w, ok := c.velocity[key]
+	if !ok || now.Sub(w.start) >= c.opts.VelocityWindow {
+		w = &clickWindow{start: now}
+		c.velocity[key] = w
+	}
+	w.n++
+	return w.n
+}
+
+// sweep drops expired state about once a minute. c.mu must be held.
+func (c *ClickQuality) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+	for k, at := range c.recent {
+		if now.Sub(at) >= c.opts.DedupeWindow {
+			delete(c.recent, k)
+		}
+	}
+	for k, at := range c.impressions {
+		if now.Sub(at) >= c.opts.ImpressionTTL {
+			delete(c.impressions, k)
+		}
+	}
+	for k, w := range c.velocity {
+		if now.Sub(w.start) >= c.opts.VelocityWindow {
+			delete(c.velocity, k)
+		}
+	}
+}
+
+func (c *ClickQuality) isDatacenterIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range c.opts.DatacenterRanges {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsHeadlessUA reports whether ua is empty or belongs to a headless browser,
+// automation driver or HTTP library.
+func IsHeadlessUA(ua string) bool {
+	l := strings.ToLower(strings.TrimSpace(ua))
+	if l == "" {
+		return true
+	}
+	for _, m := range headlessUAMarkers {
+		if strings.Contains(l, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadIPRanges reads CIDR networks, one per line, from path. Blank lines and
+// text after "#" are ignored.
+func LoadIPRanges(path string) ([]*net.IPNet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ranges []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		ranges = append(ranges, n)
+	}
+	return ranges, scanner.Err()
+}
+
+// JoinClickReasons formats reasons for storage, sorted so equal sets compare
+// equal.
+func JoinClickReasons(reasons []string) string {
+	sorted := append([]string(nil), reasons...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testBrowserUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36"
+
+// cleanClick is a click on a SERP served long enough ago, from a browser,
+// over a validly signed link.
+func cleanClick(ip string) ClickSignals {
+	return ClickSignals{
+		SerpID:      "serp1",
+		ClientIP:    ip,
+		UserAgent:   testBrowserUA,
+		Ad:          "1|0|advertiser.example|shoes",
+		ShownAt:     time.Now().Add(-10 * time.Second),
+		LinkVerdict: VerdictValid,
+	}
+}
+
+func TestClickQualityDedupe(t *testing.T) {
+	c := NewClickQuality(ClickQualityOptions{DedupeWindow: time.Minute})
+
+	if a := c.Assess(cleanClick("203.0.113.7")); a.Duplicate {
+		t.Fatal("first click marked duplicate")
+	}
+	if a := c.Assess(cleanClick("203.0.113.7")); !a.Duplicate {
+		t.Error("repeat click not marked duplicate")
+	}
+
+	other := cleanClick("203.0.113.7")
+	other.Ad = "2|0|other.example|shoes"
+	if a := c.Assess(other); a.Duplicate {
+		t.Error("click on another ad marked duplicate")
+	}
+	if a := c.Assess(cleanClick("198.51.100.1")); a.Duplicate {
+		t.Error("click from another visitor marked duplicate")
+	}
+
+	off := NewClickQuality(ClickQualityOptions{})
+	off.Assess(cleanClick("203.0.113.7"))
+	if a := off.Assess(cleanClick("203.0.113.7")); a.Duplicate {
+		t.Error("repeat marked duplicate with dedupe disabled")
+	}
+}
+
+func TestClickQualityScoring(t *testing.T) {
+	_, datacenter, _ := net.ParseCIDR("192.0.2.0/24")
+	c := NewClickQuality(ClickQualityOptions{MinClickDelay: time.Second, ImpressionTTL: time.Hour, DatacenterRanges: []*net.IPNet{datacenter}})
+
+	tests := []struct {
+		name    string
+		edit    func(*ClickSignals)
+		reasons []string
+		score   int
+	}{
+		{"clean", func(s *ClickSignals) {}, nil, 0},
+		{"no impression", func(s *ClickSignals) { s.SerpID = ""; s.ShownAt = time.Time{} }, []string{ClickReasonNoImpression}, 40},
+		{"fast click", func(s *ClickSignals) { s.ShownAt = time.Now() }, []string{ClickReasonFastClick}, 30},
+		{"datacenter", func(s *ClickSignals) { s.ClientIP = "192.0.2.10" }, []string{ClickReasonDatacenterIP}, 40},
+		{"headless", func(s *ClickSignals) { s.UserAgent = "Mozilla/5.0 HeadlessChrome/120.0" }, []string{ClickReasonHeadlessUA}, 50},
+		{"unverified", func(s *ClickSignals) { s.LinkVerdict = VerdictUnsigned }, []string{ClickReasonUnverifiedLink}, 20},
+		{"capped", func(s *ClickSignals) {
+			s.SerpID, s.ShownAt, s.ClientIP, s.UserAgent, s.LinkVerdict = "", time.Time{}, "192.0.2.10", "", VerdictInvalid
+		}, []string{ClickReasonNoImpression, ClickReasonDatacenterIP, ClickReasonHeadlessUA, ClickReasonUnverifiedLink}, 100},
+	}
+	for _, tt := range tests {
+		s := cleanClick("203.0.113.7")
+		tt.edit(&s)
+		a := c.Assess(s)
+		if !reflect.DeepEqual(a.Reasons, tt.reasons) || a.Score != tt.score {
+			t.Errorf("%s: got %v score %d, want %v score %d", tt.name, a.Reasons, a.Score, tt.reasons, tt.score)
+		}
+	}
+}
+
+func TestClickQualityRecordedImpressionWins(t *testing.T) {
+	c := NewClickQuality(ClickQualityOptions{MinClickDelay: time.Second, ImpressionTTL: time.Hour})
+	c.RecordImpression("serp1")
+
+	// The SERP was served just now, whatever the link claims
+	if a := c.Assess(cleanClick("203.0.113.7")); !reflect.DeepEqual(a.Reasons, []string{ClickReasonFastClick}) {
+		t.Errorf("reasons = %v, want fast_click", a.Reasons)
+	}
+}
+
+func TestClickQualityVelocity(t *testing.T) {
+	c := NewClickQuality(ClickQualityOptions{DedupeWindow: time.Minute, VelocityWindow: time.Minute, IPClickLimit: 2, IPUAClickLimit: 3})
+
+	c.Assess(cleanClick("203.0.113.7"))
+	c.Assess(cleanClick("203.0.113.7")) // a duplicate still counts
+
+	third := cleanClick("203.0.113.7")
+	third.Ad = "2|0|other.example|shoes"
+	if a := c.Assess(third); !reflect.DeepEqual(a.Reasons, []string{ClickReasonIPVelocity}) {
+		t.Errorf("third click reasons = %v, want ip_velocity", a.Reasons)
+	}
+	fourth := cleanClick("203.0.113.7")
+	fourth.Ad = "3|0|third.example|shoes"
+	if a := c.Assess(fourth); !reflect.DeepEqual(a.Reasons, []string{ClickReasonIPVelocity, ClickReasonIPUAVelocity}) {
+		t.Errorf("fourth click reasons = %v, want ip_velocity and ip_ua_velocity", a.Reasons)
+	}
+	if a := c.Assess(cleanClick("198.51.100.1")); len(a.Reasons) != 0 {
+		t.Errorf("other IP reasons = %v, want none", a.Reasons)
+	}
+}
+
+func TestLoadIPRanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	os.WriteFile(path, []byte("# cloud\n192.0.2.0/24\n\n2001:db8::/32 # v6\n"), 0o644)
+
+	ranges, err := LoadIPRanges(path)
+	if err != nil || len(ranges) != 2 {
+		t.Fatalf("LoadIPRanges = %v, %v", ranges, err)
+	}
+
+	os.WriteFile(path, []byte("192.0.2.0/24\nnot-a-cidr\n"), 0o644)
+	if _, err := LoadIPRanges(path); err == nil {
+		t.Error("want an error for a bad line")
+	}
+}
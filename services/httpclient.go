@@ -0,0 +1,213 @@
+package services
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamStats is published at /debug/vars as "upstream", with counters
+// prefixed by the client name (e.g. "keyword_api.retries").
+var upstreamStats = expvar.NewMap("upstream")
+
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// ResilientOptions configures a ResilientClient.
+type ResilientOptions struct {
+	// Timeout is the whole budget for one call, retries included. It is
+	// further bounded by the caller's context.
+	Timeout time.Duration
+	// MaxRetries is how many times a failed GET is retried.
+	MaxRetries int
+	// RetryBackoff is the base delay before a retry; it doubles per attempt
+	// and is jittered.
+	RetryBackoff time.Duration
+	// BreakerThreshold consecutive failures open the circuit for
+	// BreakerCooldown, after which a single probe call is let through.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// ResilientClient performs idempotent GETs against one upstream with a
+// latency budget, bounded jittered retries and a circuit breaker, so a
+// degraded upstream fails fast to the caller's fallback.
+type ResilientClient struct {
+	name    string
+	opts    ResilientOptions
+	client  *http.Client
+	breaker *circuitBreaker
+}
+
+func NewResilientClient(name string, opts ResilientOptions) *ResilientClient {
+	return &ResilientClient{
+		name:    name,
+		opts:    opts,
+		client:  &http.Client{},
+		breaker: &circuitBreaker{threshold: opts.BreakerThreshold, cooldown: opts.BreakerCooldown},
+	}
+}
+
+// Get fetches rawURL and returns the (gunzipped) body of a 2xx response.
+func (c *ResilientClient) Get(ctx context.Context, rawURL string, header http.Header) ([]byte, error) {
+	if !c.breaker.allow() {
+		upstreamStats.Add(c.name+".short_circuited", 1)
+		return nil, fmt.Errorf("%s: %w", c.name, ErrCircuitOpen)
+	}
+
+	if c.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+	}
+
+	upstreamStats.Add(c.name+".calls", 1)
+	start := time.Now()
+
+	var body []byte
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		body, retryable, err = c.do(ctx, rawURL, header)
+		if err == nil || !retryable || attempt >= c.opts.MaxRetries {
+			break
+		}
+
+		delay := c.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			break
+		}
+		upstreamStats.Add(c.name+".retries", 1)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	upstreamStats.Add(c.name+".latency_ms_total", time.Since(start).Milliseconds())
+	if err != nil {
+		upstreamStats.Add(c.name+".failures", 1)
+		// A call the client abandoned says nothing about upstream health
+		if errors.Is(err, context.Canceled) {
+			c.breaker.abandon()
+		} else {
+			c.breaker.failure()
+		}
+		return nil, err
+	}
+	c.breaker.success()
+	return body, nil
+}
+
+// do performs a single attempt and reports whether a failure is worth
+// retrying: network errors, 429 and 5xx are; other statuses are not.
+func (c *ResilientClient) do(ctx context.Context, rawURL string, header http.Header) ([]byte, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return nil, retryable, fmt.Errorf("%s: unexpected status %d", c.name, resp.StatusCode)
+	}
+
+	var reader io.ReadCloser = resp.Body
+	if strings.Contains(strings.ToLower(resp.Header.Get("Content-Encoding")), "gzip") {
+		if gr, err := gzip.NewReader(resp.Body); err == nil {
+			defer gr.Close()
+			reader = gr
+		}
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	return body, false, nil
+}
+
+func (c *ResilientClient) backoff(attempt int) time.Duration {
+	base := c.opts.RetryBackoff << attempt
+	if base <= 0 {
+		return 0
+	}
+	// Full jitter between half and the whole backoff
+	return base/2 + time.Duration(rand.Int63n(int64(base/2)+1))
+}
+
+// circuitBreaker opens after threshold consecutive failures. While open,
+// calls are refused until cooldown has passed; then one probe is allowed
+// (half-open) and its outcome closes or re-opens the circuit.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// abandon releases a half-open probe whose outcome is unknown.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
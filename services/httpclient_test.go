@@ -0,0 +1,107 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// statusServer answers with the status held in status and counts requests.
+func statusServer(t *testing.T, status *int32, hits *int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		w.WriteHeader(int(atomic.LoadInt32(status)))
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestResilientClientRetryBudget(t *testing.T) {
+	var hits int32
+	status := int32(http.StatusServiceUnavailable)
+	srv := statusServer(t, &status, &hits)
+	c := NewResilientClient("test_retry", ResilientOptions{Timeout: time.Second, MaxRetries: 2, RetryBackoff: time.Millisecond})
+
+	if _, err := c.Get(context.Background(), srv.URL, nil); err == nil {
+		t.Fatal("want an error for 503")
+	}
+	if n := atomic.LoadInt32(&hits); n != 3 {
+		t.Errorf("503 attempted %d times, want 1 + 2 retries", n)
+	}
+
+	atomic.StoreInt32(&hits, 0)
+	atomic.StoreInt32(&status, http.StatusNotFound)
+	if _, err := c.Get(context.Background(), srv.URL, nil); err == nil {
+		t.Fatal("want an error for 404")
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("404 attempted %d times, want no retries", n)
+	}
+}
+
+func TestResilientClientTimeoutBoundsRetries(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	c := NewResilientClient("test_timeout", ResilientOptions{Timeout: 50 * time.Millisecond, MaxRetries: 5, RetryBackoff: time.Millisecond})
+
+	start := time.Now()
+	if _, err := c.Get(context.Background(), srv.URL, nil); err == nil {
+		t.Fatal("want a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("took %s with a 50ms budget", elapsed)
+	}
+}
+
+func TestCircuitBreakerOpensAndHalfOpens(t *testing.T) {
+	var hits int32
+	status := int32(http.StatusInternalServerError)
+	srv := statusServer(t, &status, &hits)
+	c := NewResilientClient("test_breaker", ResilientOptions{Timeout: time.Second, BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond})
+	get := func() error {
+		_, err := c.Get(context.Background(), srv.URL, nil)
+		return err
+	}
+
+	get()
+	get()
+	if err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("third call error = %v, want ErrCircuitOpen", err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Fatalf("upstream called %d times while open, want 2", n)
+	}
+
+	// Half-open: one probe goes through and fails, so the circuit re-opens
+	time.Sleep(60 * time.Millisecond)
+	if err := get(); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("probe error = %v, want the upstream failure", err)
+	}
+	if err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("after failed probe error = %v, want ErrCircuitOpen", err)
+	}
+
+	// A successful probe closes it again
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&status, http.StatusOK)
+	if err := get(); err != nil {
+		t.Fatalf("probe error = %v, want success", err)
+	}
+	if err := get(); err != nil {
+		t.Fatalf("after successful probe error = %v", err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 5 {
+		t.Errorf("upstream called %d times, want 5", n)
+	}
+}
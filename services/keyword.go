@@ -2,16 +2,15 @@ package services
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
-	"time"
 
 	"adserving/models"
 )
@@ -26,24 +25,33 @@ var DefaultKeywords = []string{
 
 var DefaultKeywordIDs = []int64{0, 0, 0}
 
+// ErrNoKeywords is returned, along with the defaults, when a provider has
+// nothing to offer.
+var ErrNoKeywords = errors.New("no keywords")
+
 type KeywordService struct {
 	apiBaseURL string
-	client     *http.Client
+	client     *ResilientClient
 }
 
-func NewKeywordService(apiBaseURL string) *KeywordService {
+func NewKeywordService(apiBaseURL string, client *ResilientClient) *KeywordService {
 	if apiBaseURL == "" {
 		apiBaseURL = defaultAPIBase
 	}
 	return &KeywordService{
 		apiBaseURL: apiBaseURL,
-		client:     &http.Client{Timeout: 8 * time.Second},
+		client:     client,
 	}
 }
 
-func (s *KeywordService) FetchKeywords(params models.RenderParams) ([]string, []int64, error) {
+func (s *KeywordService) FetchKeywords(ctx context.Context, params models.RenderParams) ([]string, []int64, error) {
 	q := url.Values{}
 
+	// Partner attribution, tags and feature flags
+	for k, v := range params.PartnerParams {
+		q.Set(k, v)
+	}
+
 	// maxno/actno from template slot count
 	maxno := "5"
 	if params.MaxNumber > 0 {
@@ -53,34 +61,6 @@ func (s *KeywordService) FetchKeywords(params models.RenderParams) ([]string, []
 	q.Set("actno", maxno)
 	q.Set("json", "1")
 	q.Set("type", "1")
-	q.Set("https", "1")
-
-	// Hardcoded partner/publisher params
-	q.Set("csid", "8CUJM46V5")
-	q.Set("pid", "8POJDA6W3")
-	q.Set("partnerid", "7PRFT79UO")
-	q.Set("fpid", "800015395")
-	q.Set("crid", "849176236")
-
-	// Feature flags
-	q.Set("combineExpired", "1")
-	q.Set("fm_skc", "1")
-	q.Set("lmsc", "1")
-	q.Set("hs", "3")
-	q.Set("kf", "0")
-	q.Set("kwrd", "0")
-	q.Set("py", "1")
-	q.Set("pt", "60")
-	q.Set("uftr", "0")
-	q.Set("ugd", "4")
-	q.Set("ykf", "1")
-	q.Set("stag_tq_block", "1")
-	q.Set("calling_source", "cm")
-
-	// Tags
-	q.Set("pstag", "skenzo_test")
-	q.Set("stags", "skenzo_test")
-	q.Set("mtags", "{perform,BT1_sp},{sem,app,dmsedo,mva,stm,conndigi,pdeal,audext,conn,ginsu}")
 
 	// Dynamic params with defaults
 	if params.CountryCode != "" {
@@ -125,38 +105,19 @@ func (s *KeywordService) FetchKeywords(params models.RenderParams) ([]string, []
 	apiURL := s.apiBaseURL + "?" + q.Encode()
 	log.Printf("Keyword API URL: %s", apiURL)
 
-	req, err := http.NewRequest("GET", apiURL, nil)
-	if err != nil {
-		log.Printf("keyword API request error: %v, using defaults", err)
-		return DefaultKeywords, DefaultKeywordIDs, nil
-	}
-	req.Header.Set("User-Agent", "KeywordService/1.0")
-
-	resp, err := s.client.Do(req)
+	body, err := s.client.Get(ctx, apiURL, http.Header{"User-Agent": {"KeywordService/1.0"}})
 	if err != nil {
 		log.Printf("keyword API fetch error: %v, using defaults", err)
-		return DefaultKeywords, DefaultKeywordIDs, nil
+		return DefaultKeywords, DefaultKeywordIDs, err
 	}
-	defer resp.Body.Close()
 
-	var reader io.ReadCloser = resp.Body
-	if strings.Contains(strings.ToLower(resp.Header.Get("Content-Encoding")), "gzip") {
-		if gr, err := gzip.NewReader(resp.Body); err == nil {
-			defer gr.Close()
-			reader = gr
-		}
+	keywords, ids, err := ExtractKeywords(body)
+	if err == nil && len(keywords) == 0 {
+		err = ErrNoKeywords
 	}
-
-	body, err := io.ReadAll(reader)
 	if err != nil {
-		log.Printf("keyword API read error: %v, using defaults", err)
-		return DefaultKeywords, DefaultKeywordIDs, nil
-	}
-
-	keywords, ids, err := ExtractKeywords(body)
-	if err != nil || len(keywords) == 0 {
 		log.Printf("keyword API parse error or empty: %v, using defaults", err)
-		return DefaultKeywords, DefaultKeywordIDs, nil
+		return DefaultKeywords, DefaultKeywordIDs, err
 	}
 
 	return keywords, ids, nil
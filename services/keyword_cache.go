@@ -0,0 +1,145 @@
+package services
+
+import (
+	"context"
+	"expvar"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"adserving/models"
+)
+
+// keywordCacheStats is published at /debug/vars as "keyword_cache".
+var keywordCacheStats = expvar.NewMap("keyword_cache")
+
+// CachingKeywordProvider puts a TTL cache in front of another provider.
+// Requests with the same page context share one entry, and concurrent
+// misses for the same key wait on a single upstream call. Failed lookups
+// (which come back as defaults) are not cached. The shared call is detached
+// from the cancellation of the request that started it and bounded by
+// callTimeout instead; every request, the first included, stops waiting
+// when its own context ends.
+type CachingKeywordProvider struct {
+	next        KeywordProvider
+	ttl         time.Duration
+	maxEntries  int
+	callTimeout time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]keywordCacheEntry
+	inflight map[string]*keywordCall
+}
+
+type keywordCacheEntry struct {
+	keywords []string
+	ids      []int64
+	expires  time.Time
+}
+
+type keywordCall struct {
+	done     chan struct{}
+	keywords []string
+	ids      []int64
+	err      error
+}
+
+func NewCachingKeywordProvider(next KeywordProvider, ttl time.Duration, maxEntries int, callTimeout time.Duration) *CachingKeywordProvider {
+	return &CachingKeywordProvider{
+		next:        next,
+		ttl:         ttl,
+		maxEntries:  maxEntries,
+		callTimeout: callTimeout,
+		entries:     make(map[string]keywordCacheEntry),
+		inflight:    make(map[string]*keywordCall),
+	}
+}
+
+func (c *CachingKeywordProvider) FetchKeywords(ctx context.Context, params models.RenderParams) ([]string, []int64, error) {
+	key := keywordCacheKey(params)
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && time.Now().Before(e.expires) {
+		c.mu.Unlock()
+		keywordCacheStats.Add("hits", 1)
+		return e.keywords, e.ids, nil
+	}
+	call, ok := c.inflight[key]
+	if ok {
+		keywordCacheStats.Add("coalesced", 1)
+	} else {
+		call = &keywordCall{done: make(chan struct{})}
+		c.inflight[key] = call
+		keywordCacheStats.Add("misses", 1)
+		go c.fetch(ctx, key, call, params)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.keywords, call.ids, call.err
+	case <-ctx.Done():
+		return DefaultKeywords, DefaultKeywordIDs, ctx.Err()
+	}
+}
+
+// fetch makes the upstream call shared by every request waiting on call.
+func (c *CachingKeywordProvider) fetch(ctx context.Context, key string, call *keywordCall, params models.RenderParams) {
+	ctx = context.WithoutCancel(ctx)
+	if c.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.callTimeout)
+		defer cancel()
+	}
+	call.keywords, call.ids, call.err = c.next.FetchKeywords(ctx, params)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if call.err == nil {
+		c.store(key, keywordCacheEntry{keywords: call.keywords, ids: call.ids, expires: time.Now().Add(c.ttl)})
+	}
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// store adds an entry, first dropping expired entries and then, if the
+// cache is still full, the entries closest to expiry. c.mu must be held.
+func (c *CachingKeywordProvider) store(key string, e keywordCacheEntry) {
+	if len(c.entries) >= c.maxEntries {
+		now := time.Now()
+		for k, old := range c.entries {
+			if !now.Before(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if over := len(c.entries) - c.maxEntries + 1; over > 0 {
+		keys := make([]string, 0, len(c.entries))
+		for k := range c.entries {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return c.entries[keys[i]].expires.Before(c.entries[keys[j]].expires) })
+		for _, k := range keys[:over] {
+			delete(c.entries, k)
+		}
+		keywordCacheStats.Add("evictions", int64(over))
+	}
+	c.entries[key] = e
+}
+
+// keywordCacheKey identifies the page context the keyword API answers for:
+// domain, page URL and title, country, layout, count and partner profile.
+func keywordCacheKey(p models.RenderParams) string {
+	partner := make([]string, 0, len(p.PartnerParams))
+	for k, v := range p.PartnerParams {
+		partner = append(partner, k+"="+v)
+	}
+	sort.Strings(partner)
+
+	return strings.Join([]string{
+		p.Domain, p.ReferrerURL, p.PageTitle, p.CountryCode, p.LayoutID, strconv.Itoa(p.MaxNumber),
+		strings.Join(partner, "&"),
+	}, "\x00")
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"adserving/models"
+)
+
+// slowKeywordAPI answers every request with one keyword after delay, or
+// when the request is canceled, and counts the requests.
+func slowKeywordAPI(t *testing.T, delay time.Duration, hits *int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte(`{"k":[{"t":"running shoes","i":"7"}]}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestKeywordCache(url string) *CachingKeywordProvider {
+	client := NewResilientClient("test_keyword_api", ResilientOptions{Timeout: 2 * time.Second})
+	return NewCachingKeywordProvider(NewKeywordService(url, client), time.Minute, 100, 2*time.Second)
+}
+
+var cacheTestParams = models.RenderParams{Domain: "example.com", CountryCode: "US", MaxNumber: 3}
+
+func TestKeywordCacheCoalescesConcurrentMisses(t *testing.T) {
+	var hits int32
+	cache := newTestKeywordCache(slowKeywordAPI(t, 50*time.Millisecond, &hits).URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			kws, _, err := cache.FetchKeywords(context.Background(), cacheTestParams)
+			if err != nil || len(kws) != 1 || kws[0] != "running shoes" {
+				t.Errorf("FetchKeywords = %v, %v", kws, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, _, err := cache.FetchKeywords(context.Background(), cacheTestParams); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("upstream called %d times, want 1", n)
+	}
+}
+
+func TestKeywordCacheLeaderCancelDoesNotFailWaiters(t *testing.T) {
+	var hits int32
+	cache := newTestKeywordCache(slowKeywordAPI(t, 100*time.Millisecond, &hits).URL)
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, _, err := cache.FetchKeywords(leaderCtx, cacheTestParams)
+		leaderErr <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	waiter := make(chan []string, 1)
+	go func() {
+		kws, _, err := cache.FetchKeywords(context.Background(), cacheTestParams)
+		if err != nil {
+			t.Errorf("waiter error: %v", err)
+		}
+		waiter <- kws
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancelLeader()
+
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("leader error = %v, want context.Canceled", err)
+	}
+	if kws := <-waiter; len(kws) != 1 || kws[0] != "running shoes" {
+		t.Errorf("waiter got %v, want the upstream keyword", kws)
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("upstream called %d times, want 1", n)
+	}
+}
+
+func TestKeywordCacheWaiterStopsAtItsDeadline(t *testing.T) {
+	var hits int32
+	cache := newTestKeywordCache(slowKeywordAPI(t, 300*time.Millisecond, &hits).URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	kws, _, err := cache.FetchKeywords(ctx, cacheTestParams)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want context.DeadlineExceeded", err)
+	}
+	if len(kws) != len(DefaultKeywords) || kws[0] != DefaultKeywords[0] {
+		t.Errorf("got %v, want the default keywords", kws)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("returned after %s, want about 30ms", elapsed)
+	}
+}
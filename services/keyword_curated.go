@@ -0,0 +1,64 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"adserving/models"
+	"adserving/utils"
+)
+
+// CuratedKeywordProvider serves hand-picked keywords from the
+// curated_keyword table. A publisher's own rows come first, then global
+// rows (publisher_id 0); rows may be limited to one country.
+type CuratedKeywordProvider struct {
+	db *sql.DB
+}
+
+func NewCuratedKeywordProvider(db *sql.DB) *CuratedKeywordProvider {
+	return &CuratedKeywordProvider{db: db}
+}
+
+func (s *CuratedKeywordProvider) FetchKeywords(ctx context.Context, params models.RenderParams) ([]string, []int64, error) {
+	limit := params.MaxNumber
+	if limit <= 0 {
+		limit = 5
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, keyword FROM curated_keyword
+		WHERE enabled = 1 AND publisher_id IN (?, 0)
+			AND (country_code IS NULL OR country_code = '' OR country_code = ?)
+		ORDER BY publisher_id DESC, priority DESC, id
+		LIMIT ?
+	`, utils.AtoiOrZero(params.PublisherID), params.CountryCode, limit)
+	if err != nil {
+		log.Printf("curated keyword query error: %v, using defaults", err)
+		return DefaultKeywords, DefaultKeywordIDs, err
+	}
+	defer rows.Close()
+
+	var keywords []string
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var kw string
+		if err := rows.Scan(&id, &kw); err != nil {
+			log.Printf("curated keyword scan error: %v, using defaults", err)
+			return DefaultKeywords, DefaultKeywordIDs, err
+		}
+		keywords = append(keywords, kw)
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	if err == nil && len(keywords) == 0 {
+		err = ErrNoKeywords
+	}
+	if err != nil {
+		log.Printf("curated keywords error or empty: %v, using defaults", err)
+		return DefaultKeywords, DefaultKeywordIDs, err
+	}
+
+	return keywords, ids, nil
+}
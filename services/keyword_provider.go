@@ -0,0 +1,60 @@
+package services
+
+import (
+	"context"
+	"log"
+
+	"adserving/models"
+)
+
+// Names under which keyword providers are registered; a rule action picks
+// one with keyword_provider.
+const (
+	KeywordProviderAPI     = "api"
+	KeywordProviderStatic  = "static"
+	KeywordProviderCurated = "curated"
+)
+
+// KeywordProvider supplies the keywords shown in a keyword slot. Like
+// KeywordService, implementations never leave the slot empty: on failure
+// they return DefaultKeywords together with the error, including when ctx
+// is canceled before they finish.
+type KeywordProvider interface {
+	FetchKeywords(ctx context.Context, params models.RenderParams) ([]string, []int64, error)
+}
+
+// KeywordProviders is the set of configured providers, looked up by name.
+type KeywordProviders struct {
+	providers   map[string]KeywordProvider
+	defaultName string
+}
+
+func NewKeywordProviders(defaultName string) *KeywordProviders {
+	return &KeywordProviders{providers: make(map[string]KeywordProvider), defaultName: defaultName}
+}
+
+func (p *KeywordProviders) Register(name string, provider KeywordProvider) {
+	p.providers[name] = provider
+}
+
+// Get returns the named provider, or the default one when name is empty or
+// not configured on this server.
+func (p *KeywordProviders) Get(name string) KeywordProvider {
+	if provider, ok := p.providers[name]; ok {
+		return provider
+	}
+	if name != "" {
+		log.Printf("keyword provider %q not configured, using %q", name, p.defaultName)
+	}
+	return p.providers[p.defaultName]
+}
+
+// KnownKeywordProvider reports whether name is a provider this codebase
+// implements, whether or not it is configured.
+func KnownKeywordProvider(name string) bool {
+	switch name {
+	case KeywordProviderAPI, KeywordProviderStatic, KeywordProviderCurated:
+		return true
+	}
+	return false
+}
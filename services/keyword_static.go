@@ -0,0 +1,39 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"adserving/models"
+)
+
+// StaticKeywordProvider serves a fixed keyword list read from a JSON file in
+// the keyword API's own format: {"k":[{"t":"title","i":123}, ...]}.
+type StaticKeywordProvider struct {
+	keywords []string
+	ids      []int64
+}
+
+func NewStaticKeywordProvider(path string) (*StaticKeywordProvider, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keywords, ids, err := ExtractKeywords(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(keywords) == 0 {
+		return nil, fmt.Errorf("%s: no keywords", path)
+	}
+	return &StaticKeywordProvider{keywords: keywords, ids: ids}, nil
+}
+
+func (s *StaticKeywordProvider) FetchKeywords(ctx context.Context, params models.RenderParams) ([]string, []int64, error) {
+	n := len(s.keywords)
+	if params.MaxNumber > 0 && params.MaxNumber < n {
+		n = params.MaxNumber
+	}
+	return s.keywords[:n], s.ids[:n], nil
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Link signature verdicts, stored with every tracking row.
+const (
+	VerdictValid    = "valid"
+	VerdictUnsigned = "unsigned"
+	VerdictExpired  = "expired"
+	VerdictInvalid  = "invalid"
+)
+
+// linkSignatureStats is published at /debug/vars as "link_signatures",
+// keyed by "<endpoint>.<verdict>" plus "<endpoint>.refused".
+var linkSignatureStats = expvar.NewMap("link_signatures")
+
+// Signature modes: enforce refuses links that are not validly signed, flag
+// only records the verdict. Ad clicks are redirected on a valid link only,
+// whatever the mode.
+const (
+	SignatureModeFlag    = "flag"
+	SignatureModeEnforce = "enforce"
+)
+
+// maxClockSkew is how far in the future a link's timestamp may be.
+const maxClockSkew = 5 * time.Minute
+
+type SigningKey struct {
+	ID     string
+	Secret []byte
+}
+
+// ParseSigningKeys reads a key set written as "id:secret,id:secret". The
+// first key signs new links; all of them verify, so a key can be rotated
+// out by adding its replacement in front and dropping it once its links
+// have expired.
+func ParseSigningKeys(spec string) ([]SigningKey, error) {
+	var keys []SigningKey
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(part, ":")
+		if !ok || id == "" || strings.ContainsAny(id, "&=") {
+			return nil, fmt.Errorf("signing key %q: want id:secret", part)
+		}
+		if len(secret) < 16 {
+			return nil, fmt.Errorf("signing key %q: secret must be at least 16 bytes", id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("signing key %q listed twice", id)
+		}
+		seen[id] = true
+		keys = append(keys, SigningKey{ID: id, Secret: []byte(secret)})
+	}
+	return keys, nil
+}
+
+// URLSigner adds an HMAC-SHA256 signature to the query of the tracking
+// links we generate and checks it when they come back. The signature
+// covers every parameter plus "ts" (signing time) and "kv" (key id), and
+// is carried in "sig".
+type URLSigner struct {
+	keys    []SigningKey
+	ttl     time.Duration
+	enforce bool
+}
+
+// NewURLSigner returns a signer whose links are valid for ttl. With
+// enforce, only valid links are allowed; otherwise the verdict is only
+// recorded. At least one key is required.
+func NewURLSigner(keys []SigningKey, ttl time.Duration, enforce bool) (*URLSigner, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return &URLSigner{keys: keys, ttl: ttl, enforce: enforce}, nil
+}
+
+// Sign adds ts, kv and sig to v.
+func (s *URLSigner) Sign(v url.Values) {
+	key := s.keys[0]
+	v.Del("sig")
+	v.Set("ts", strconv.FormatInt(time.Now().Unix(), 10))
+	v.Set("kv", key.ID)
+	v.Set("sig", signature(key.Secret, v))
+}
+
+// Verify returns the verdict for the parameters of an incoming link.
+func (s *URLSigner) Verify(v url.Values) string {
+	sig := v.Get("sig")
+	if sig == "" {
+		return VerdictUnsigned
+	}
+
+	var secret []byte
+	for _, k := range s.keys {
+		if k.ID == v.Get("kv") {
+			secret = k.Secret
+			break
+		}
+	}
+	if secret == nil {
+		return VerdictInvalid
+	}
+
+	unsigned := url.Values{}
+	for k, vals := range v {
+		if k != "sig" {
+			unsigned[k] = vals
+		}
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, unsigned))) {
+		return VerdictInvalid
+	}
+
+	ts, err := strconv.ParseInt(v.Get("ts"), 10, 64)
+	if err != nil {
+		return VerdictInvalid
+	}
+	age := time.Since(time.Unix(ts, 0))
+	if age < -maxClockSkew {
+		return VerdictInvalid
+	}
+	if age > s.ttl {
+		return VerdictExpired
+	}
+	return VerdictValid
+}
+
+// Allow reports whether a link with the given verdict may be acted on.
+func (s *URLSigner) Allow(verdict string) bool {
+	if !s.enforce {
+		return true
+	}
+	return verdict == VerdictValid
+}
+
+// Check verifies the link an endpoint was called with, counts the verdict
+// and reports whether the request may be acted on.
+func (s *URLSigner) Check(endpoint string, v url.Values) (string, bool) {
+	verdict := s.Verify(v)
+	linkSignatureStats.Add(endpoint+"."+verdict, 1)
+	ok := s.Allow(verdict)
+	if !ok {
+		linkSignatureStats.Add(endpoint+".refused", 1)
+	}
+	return verdict, ok
+}
+
+// signature is the HMAC of v's canonical encoding (sorted by key), which
+// must not contain sig.
+func signature(secret []byte, v url.Values) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(v.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,12 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestURLSignerRequiresKeys(t *testing.T) {
+	if _, err := NewURLSigner(nil, time.Hour, false); err == nil {
+		t.Error("NewURLSigner without keys: want an error")
+	}
+}
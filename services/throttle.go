@@ -0,0 +1,69 @@
+package services
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Throttler decides whether a request is served normally or shed, either
+// by a percentage of traffic or by a per-publisher QPS cap.
+type Throttler struct {
+	mu      sync.Mutex
+	buckets map[int]*tokenBucket
+}
+
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewThrottler() *Throttler {
+	return &Throttler{buckets: make(map[int]*tokenBucket)}
+}
+
+// Allow reports whether a request for the publisher may be served.
+// throttlePercent (0-100) is the share of traffic to shed at random and
+// qpsCap (0 = none) the sustained requests per second allowed. When the
+// request is shed, reason is "percent" or "qps".
+func (t *Throttler) Allow(publisherID, throttlePercent int, qpsCap float64) (bool, string) {
+	if throttlePercent > 0 && rand.Intn(100) < throttlePercent {
+		return false, "percent"
+	}
+	if qpsCap > 0 && !t.take(publisherID, qpsCap) {
+		return false, "qps"
+	}
+	return true, ""
+}
+
+// take removes one token from the publisher's bucket, which refills at
+// rate tokens per second and holds at most one second's worth.
+func (t *Throttler) take(publisherID int, rate float64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	b, ok := t.buckets[publisherID]
+	if !ok {
+		b = &tokenBucket{rate: rate, tokens: rate, last: now}
+		t.buckets[publisherID] = b
+	}
+
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	b.rate = rate
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
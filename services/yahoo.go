@@ -1,106 +1,173 @@
 package services
 
 import (
-	"compress/gzip"
+	"context"
 	"encoding/xml"
+	"fmt"
 	"html"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
-	"time"
 
 	"adserving/models"
 )
 
-const yahooXMLURL = "https://contextual-stage.media.net/test/mock/provider/yahoo.xml"
-
-var DefaultAds = []models.YahooAd{
-	{
-		TitleHTML: template.HTML("Shop Top Deals Today"),
-		DescHTML:  template.HTML("Find amazing discounts on popular products. Limited time offers available now."),
-		Link:      "https://example.com/deals",
-		Host:      "example.com",
-	},
-	{
-		TitleHTML: template.HTML("Compare Best Prices"),
-		DescHTML:  template.HTML("Get the best prices from trusted retailers. Save money on your next purchase."),
-		Link:      "https://example.com/compare",
-		Host:      "example.com",
-	},
-	{
-		TitleHTML: template.HTML("Exclusive Online Offers"),
-		DescHTML:  template.HTML("Special offers only available online. Don't miss out on these savings."),
-		Link:      "https://example.com/offers",
-		Host:      "example.com",
-	},
+const defaultAdsBase = "https://contextual-stage.media.net/test/mock/provider/yahoo.xml"
+
+// yahooResults is the Yahoo XML feed response. Only the fields we use are
+// mapped.
+type yahooResults struct {
+	ResultSet struct {
+		Listings []yahooListing `xml:"Listing"`
+	} `xml:"ResultSet"`
+}
+
+type yahooListing struct {
+	Rank          string `xml:"rank,attr"`
+	Title         string `xml:"title,attr"`
+	Description   string `xml:"description,attr"`
+	SiteHost      string `xml:"siteHost,attr"`
+	ClickUrl      string `xml:"ClickUrl"`
+	ImpressionUrl string `xml:"ImpressionUrl"`
+	Extensions    struct {
+		ActionExtension struct {
+			Items []struct {
+				Text string `xml:"text"`
+				Link string `xml:"link"`
+			} `xml:"actionItem"`
+		} `xml:"actionExtension"`
+	} `xml:"Extensions"`
 }
 
+// YahooService is the adapter for the Yahoo XML ads feed.
 type YahooService struct {
-	client *http.Client
+	baseURL   string
+	partner   string
+	sourceTag string
+	client    *ResilientClient
 }
 
-func NewYahooService() *YahooService {
-	return &YahooService{client: &http.Client{Timeout: 8 * time.Second}}
+// NewYahooService calls the XML feed at baseURL. partner identifies us to
+// the feed; sourceTag, when set, is sent as the traffic type, suffixed with
+// the publisher id so the feed can report per publisher.
+func NewYahooService(baseURL, partner, sourceTag string, client *ResilientClient) *YahooService {
+	if baseURL == "" {
+		baseURL = defaultAdsBase
+	}
+	return &YahooService{
+		baseURL:   baseURL,
+		partner:   partner,
+		sourceTag: sourceTag,
+		client:    client,
+	}
 }
 
-func (s *YahooService) FetchAds() ([]models.YahooAd, error) {
-	req, err := http.NewRequest("GET", yahooXMLURL, nil)
-	if err != nil {
-		log.Printf("ads API request error: %v, using defaults", err)
-		return DefaultAds, nil
+// feedURL builds the feed request for req.
+func (s *YahooService) feedURL(req models.AdRequest) string {
+	q := url.Values{}
+	if s.partner != "" {
+		q.Set("Partner", s.partner)
+	}
+	if s.sourceTag != "" {
+		tag := s.sourceTag
+		if req.PublisherID != "" {
+			tag += "_" + req.PublisherID
+		}
+		q.Set("type", tag)
 	}
-	req.Header.Set("User-Agent", "AdService/1.0")
 
-	resp, err := s.client.Do(req)
-	if err != nil {
-		log.Printf("ads API fetch error: %v, using defaults", err)
-		return DefaultAds, nil
+	q.Set("Keywords", req.Query)
+	q.Set("keywordCharEnc", "utf8")
+	q.Set("outputCharEnc", "utf8")
+
+	cc := req.CountryCode
+	if cc == "" {
+		cc = "US"
 	}
-	defer resp.Body.Close()
+	q.Set("mkt", strings.ToLower(cc))
 
-	var reader io.ReadCloser = resp.Body
-	if strings.Contains(strings.ToLower(resp.Header.Get("Content-Encoding")), "gzip") {
-		if gr, err := gzip.NewReader(resp.Body); err == nil {
-			defer gr.Close()
-			reader = gr
-		}
+	if req.MaxCount > 0 {
+		q.Set("maxCount", strconv.Itoa(req.MaxCount))
+	}
+	if req.PageURL != "" {
+		q.Set("serveUrl", req.PageURL)
 	}
 
-	raw, err := io.ReadAll(reader)
+	// End-user hints used by the feed for targeting and traffic quality
+	affil := url.Values{}
+	if req.ClientIP != "" {
+		affil.Set("ip", req.ClientIP)
+	}
+	if req.UserAgent != "" {
+		affil.Set("ua", req.UserAgent)
+	}
+	if len(affil) > 0 {
+		q.Set("affilData", affil.Encode())
+	}
+
+	sep := "?"
+	if strings.Contains(s.baseURL, "?") {
+		sep = "&"
+	}
+	return s.baseURL + sep + q.Encode()
+}
+
+func (s *YahooService) FetchAds(ctx context.Context, req models.AdRequest) ([]models.Ad, error) {
+	raw, err := s.client.Get(ctx, s.feedURL(req), http.Header{"User-Agent": {"AdService/1.0"}})
 	if err != nil {
-		log.Printf("ads API read error: %v, using defaults", err)
-		return DefaultAds, nil
+		log.Printf("ads API fetch error: %v, using defaults", err)
+		return DefaultAds, err
 	}
 
-	var doc models.YahooResults
+	var doc yahooResults
 	if err := xml.Unmarshal(raw, &doc); err != nil {
 		log.Printf("ads API parse error: %v, using defaults", err)
-		return DefaultAds, nil
+		return DefaultAds, fmt.Errorf("xml decode: %w", err)
 	}
 
-	var ads []models.YahooAd
+	var ads []models.Ad
 	for _, li := range doc.ResultSet.Listings {
-		link := strings.TrimSpace(li.ClickUrl.URL)
-		if link == "" && len(li.Extensions.ActionExtension.Items) > 0 {
-			link = strings.TrimSpace(li.Extensions.ActionExtension.Items[0].Link)
+		var sitelinks []models.AdSitelink
+		for _, item := range li.Extensions.ActionExtension.Items {
+			text, link := strings.TrimSpace(item.Text), strings.TrimSpace(item.Link)
+			if text != "" && link != "" {
+				sitelinks = append(sitelinks, models.AdSitelink{Text: html.UnescapeString(text), URL: link})
+			}
+		}
+
+		link := strings.TrimSpace(li.ClickUrl)
+		if link == "" && len(sitelinks) > 0 {
+			link = sitelinks[0].URL
 		}
 		if link == "" {
 			continue
 		}
-		ads = append(ads, models.YahooAd{
-			TitleHTML: template.HTML(html.UnescapeString(strings.TrimSpace(li.Title))),
-			DescHTML:  template.HTML(html.UnescapeString(strings.TrimSpace(li.Description))),
-			Link:      link,
-			Host:      strings.TrimSpace(li.SiteHost),
+		rank, err := strconv.Atoi(strings.TrimSpace(li.Rank))
+		if err != nil || rank <= 0 {
+			rank = len(ads) + 1
+		}
+		ads = append(ads, models.Ad{
+			Title:         template.HTML(html.UnescapeString(strings.TrimSpace(li.Title))),
+			Description:   template.HTML(html.UnescapeString(strings.TrimSpace(li.Description))),
+			DisplayURL:    strings.TrimSpace(li.SiteHost),
+			ClickURL:      link,
+			Rank:          rank,
+			Sitelinks:     sitelinks,
+			ImpressionURL: strings.TrimSpace(li.ImpressionUrl),
 		})
 	}
 
 	if len(ads) == 0 {
 		log.Printf("ads API returned no ads, using defaults")
-		return DefaultAds, nil
+		return DefaultAds, ErrNoAds
 	}
 
+	// The feed's rank, not document order, is the order it wants ads shown
+	sort.SliceStable(ads, func(i, j int) bool { return ads[i].Rank < ads[j].Rank })
+
 	return ads, nil
 }
@@ -21,7 +21,16 @@
     } catch(e) {}
   }
 
-  var CONFIG = { pid: PID ? parseInt(PID, 10) : 0, cc: 'US', tsize: '300x250', lid: '224' };
+  // lid/tsize come from the publisher's rule; data-lid/data-tsize are sent
+  // only as an override, which the server honours if the rule allows it.
+  // cc is sent only when the publisher sets data-cc; otherwise the server
+  // geolocates the visitor.
+  var CONFIG = {
+    pid: PID ? parseInt(PID, 10) : 0,
+    cc: scriptEl ? (scriptEl.getAttribute('data-cc') || '') : '',
+    tsize: scriptEl ? (scriptEl.getAttribute('data-tsize') || '') : '',
+    lid: scriptEl ? (scriptEl.getAttribute('data-lid') || '') : ''
+  };
 
   function slotIdFromEl(el) {
     if (!el) return '';
@@ -34,16 +43,16 @@
     if (!slotId) return;
 
     var p = 'slot=' + encodeURIComponent(slotId) +
-            '&cc=' + encodeURIComponent(CONFIG.cc) +
+            (CONFIG.cc ? '&cc=' + encodeURIComponent(CONFIG.cc) : '') +
             '&pid=' + encodeURIComponent(CONFIG.pid) +
-            '&tsize=' + encodeURIComponent(CONFIG.tsize) +
-            '&lid=' + encodeURIComponent(CONFIG.lid) +
+            (CONFIG.tsize ? '&tsize=' + encodeURIComponent(CONFIG.tsize) : '') +
+            (CONFIG.lid ? '&lid=' + encodeURIComponent(CONFIG.lid) : '') +
             '&d=' + encodeURIComponent(location.hostname) +
             '&ptitle=' + encodeURIComponent(document.title || '') +
             '&rurl=' + encodeURIComponent(location.href) +
             '&kwrf=' + encodeURIComponent(document.referrer || '');
 
-    var dims = CONFIG.tsize.split('x');
+    var dims = (CONFIG.tsize || '300x250').split('x');
     var iframe = document.createElement('iframe');
     iframe.src = ORIGIN + '/keyword_render?' + p;
     iframe.width = dims[0] || '300';
@@ -66,10 +75,24 @@
     return list;
   }
 
+  function resizeFrame(source, width, height) {
+    var frames = document.getElementsByTagName('iframe');
+    for (var i = 0; i < frames.length; i++) {
+      if (frames[i].contentWindow === source) {
+        if (width > 0) frames[i].width = String(width);
+        if (height > 0) frames[i].height = String(height);
+        return;
+      }
+    }
+  }
+
   window.addEventListener('message', function(e) {
-    if (e.data && e.data.type === 'impression' && e.data.url) {
+    if (!e.data) return;
+    if (e.data.type === 'impression' && e.data.url) {
       var i = new Image();
       i.src = e.data.url;
+    } else if (e.data.type === 'resize') {
+      resizeFrame(e.source, parseInt(e.data.width, 10), parseInt(e.data.height, 10));
     }
   });
 
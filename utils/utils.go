@@ -1,7 +1,10 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -10,21 +13,122 @@ import (
 	"strings"
 )
 
+var requestIDRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// NewRequestID returns a random 128-bit id, hex encoded, for linking the
+// tracking rows of one render or SERP view.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// RequestIDParam returns s if it looks like an id from NewRequestID, else
+// "", so that junk from a URL never reaches the tracking tables.
+func RequestIDParam(s string) string {
+	if requestIDRe.MatchString(s) {
+		return s
+	}
+	return ""
+}
+
 func IsBotUA(ua string) bool {
 	return strings.Contains(strings.ToLower(ua), "bot")
 }
 
+// DeviceClass buckets a user agent into bot, tablet, mobile or desktop.
+func DeviceClass(ua string) string {
+	l := strings.ToLower(ua)
+	switch {
+	case IsBotUA(ua):
+		return "bot"
+	case strings.Contains(l, "ipad") || strings.Contains(l, "tablet") ||
+		(strings.Contains(l, "android") && !strings.Contains(l, "mobile")):
+		return "tablet"
+	case strings.Contains(l, "mobi") || strings.Contains(l, "iphone") || strings.Contains(l, "android"):
+		return "mobile"
+	}
+	return "desktop"
+}
+
+// trustedProxies are the networks whose forwarding headers GetClientIP
+// believes; set once at startup by SetTrustedProxies.
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets the proxies, as a comma-separated CIDR list, whose
+// X-Forwarded-For and X-Real-IP headers are trusted.
+func SetTrustedProxies(spec string) error {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, n)
+	}
+	trustedProxies = nets
+	return nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetClientIP returns the address the request came from. Forwarding headers
+// are only read when the connection is from a trusted proxy, and then
+// X-Forwarded-For is walked from the right so that entries the client
+// wrote itself are never taken over the address our proxies saw.
 func GetClientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		return strings.TrimSpace(strings.Split(xff, ",")[0])
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if i == 0 || !isTrustedProxy(hop) {
+				return hop
+			}
+		}
 	}
 	if xri := r.Header.Get("X-Real-IP"); xri != "" {
 		return strings.TrimSpace(xri)
 	}
-	if i := strings.LastIndex(r.RemoteAddr, ":"); i > 0 {
-		return r.RemoteAddr[:i]
+	return peer
+}
+
+// GetCountryCode returns the request country: the explicit cc param wins,
+// then a geo header set by the CDN/load balancer, then "US".
+func GetCountryCode(r *http.Request) string {
+	if cc := strings.TrimSpace(r.URL.Query().Get("cc")); cc != "" {
+		return strings.ToUpper(cc)
+	}
+	for _, h := range []string{"CF-IPCountry", "X-Country-Code", "X-Geo-Country"} {
+		if cc := strings.TrimSpace(r.Header.Get(h)); cc != "" && cc != "XX" {
+			return strings.ToUpper(cc)
+		}
 	}
-	return r.RemoteAddr
+	return "US"
 }
 
 func SafeTargetURL(raw string) (string, error) {
@@ -54,6 +158,22 @@ func AtoiOrZero(s string) int {
 	return n
 }
 
+// NullIfEmpty maps "" to a SQL NULL argument.
+func NullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// NullIfZero maps 0 to a SQL NULL argument.
+func NullIfZero(n int) any {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
 func GetScheme(r *http.Request) string {
 	if r.TLS != nil {
 		return "https"
@@ -64,6 +184,11 @@ func GetScheme(r *http.Request) string {
 	return "http"
 }
 
+func FileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
 func CountKeywordSlots(templatePath string) int {
 	content, err := os.ReadFile(templatePath)
 	if err != nil {
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetClientIP(t *testing.T) {
+	if err := SetTrustedProxies("10.0.0.0/8, ::1/128"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTrustedProxies("")
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		xri    string
+		want   string
+	}{
+		{"direct", "203.0.113.7:5000", "", "", "203.0.113.7"},
+		{"direct ignores xff", "203.0.113.7:5000", "198.51.100.1", "", "203.0.113.7"},
+		{"direct ignores x-real-ip", "203.0.113.7:5000", "", "198.51.100.1", "203.0.113.7"},
+		{"proxied", "10.0.0.2:5000", "198.51.100.1", "", "198.51.100.1"},
+		{"spoofed entry before the client", "10.0.0.2:5000", "1.2.3.4, 198.51.100.1", "", "198.51.100.1"},
+		{"chain of proxies", "10.0.0.2:5000", "198.51.100.1, 10.0.0.9", "", "198.51.100.1"},
+		{"only proxies", "10.0.0.2:5000", "10.0.0.8, 10.0.0.9", "", "10.0.0.8"},
+		{"proxied x-real-ip", "[::1]:5000", "", "198.51.100.1", "198.51.100.1"},
+		{"proxy without headers", "10.0.0.2:5000", "", "", "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if tt.xri != "" {
+			r.Header.Set("X-Real-IP", tt.xri)
+		}
+		if got := GetClientIP(r); got != tt.want {
+			t.Errorf("%s: GetClientIP = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if err := SetTrustedProxies("10.0.0.0/8,bogus"); err == nil {
+		t.Error("want an error for a bad CIDR")
+	}
+}